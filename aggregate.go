@@ -0,0 +1,250 @@
+package bplustree
+
+import "bytes"
+
+// Aggregator defines an aggregate of the KVs of a tree, such as the sum of a
+// field of the Values. The aggregate of every child of an interior node is
+// stored in the node and committed with it, so that the aggregate of a range
+// is computed from the nodes on the paths to the bounds of the range.
+//
+// The aggregate of no KV is nil, Merge must be associative and return a when b
+// is nil and b when a is nil.
+type Aggregator interface {
+	// Value returns the aggregate of a single KV.
+	Value(key, value []byte) []byte
+	// Merge returns the aggregate of the KVs aggregated by a followed by the
+	// KVs aggregated by b.
+	Merge(a, b []byte) []byte
+}
+
+// WithAggregator maintains the aggregates of a in the tree, a tree loaded
+// from db must be given the Aggregator it was committed with.
+func WithAggregator(a Aggregator) Option {
+	return func(bt *BTree) {
+		bt.aggregator = a
+	}
+}
+
+// int64Aggregator aggregates an int64 field of the Values, encoded as 8 big
+// endian bytes.
+type int64Aggregator struct {
+	field func(value []byte) int64
+	merge func(a, b int64) int64
+}
+
+func (a *int64Aggregator) Value(key, value []byte) []byte {
+	return Int64ToBytes(a.field(value))
+}
+
+func (a *int64Aggregator) Merge(x, y []byte) []byte {
+	if x == nil {
+		return y
+	}
+	if y == nil {
+		return x
+	}
+	return Int64ToBytes(a.merge(BytesToInt64(x), BytesToInt64(y)))
+}
+
+// SumAggregator sums the field of the Values returned by field.
+func SumAggregator(field func(value []byte) int64) Aggregator {
+	return &int64Aggregator{field, func(a, b int64) int64 { return a + b }}
+}
+
+// MinAggregator keeps the minimum of the field of the Values returned by field.
+func MinAggregator(field func(value []byte) int64) Aggregator {
+	return &int64Aggregator{field, func(a, b int64) int64 {
+		if b < a {
+			return b
+		}
+		return a
+	}}
+}
+
+// MaxAggregator keeps the maximum of the field of the Values returned by field.
+func MaxAggregator(field func(value []byte) int64) Aggregator {
+	return &int64Aggregator{field, func(a, b int64) int64 {
+		if b > a {
+			return b
+		}
+		return a
+	}}
+}
+
+// summarize returns the number of Keys and the aggregate of the KVs under in,
+// updating the Sizes and Aggs of the KCs of the dirty interior nodes under in
+// which have been modified since they were last summarized. The KCs of the
+// nodes stored before the Sizes, whose Size is sizeUnknown, are summarized
+// from the whole subtree of their child, which is loaded. The tree must be
+// locked.
+func (bt *BTree) summarize(in *InteriorNode) (int, []byte, error) {
+	size := 0
+	var agg []byte
+	for i := 0; i < in.Count; i++ {
+		kc := &in.Kcs.data[i]
+		if kc.Size == sizeUnknown {
+			if _, err := bt.child(in, i); err != nil {
+				return 0, nil, err
+			}
+		}
+		if !in.summed || kc.Size == sizeUnknown {
+			switch child := kc.Child.(type) {
+			case *LeafNode:
+				if child.dirty || kc.Size == sizeUnknown {
+					kc.Agg = bt.aggregateLeaf(child)
+				}
+				kc.Size = child.Count
+			case *InteriorNode:
+				if child.dirty || kc.Size == sizeUnknown {
+					s, a, err := bt.summarize(child)
+					if err != nil {
+						return 0, nil, err
+					}
+					kc.Size, kc.Agg = s, a
+				}
+			}
+		}
+		size += kc.Size
+		if bt.aggregator != nil {
+			agg = bt.aggregator.Merge(agg, kc.Agg)
+		}
+	}
+	in.summed = true
+	return size, agg, nil
+}
+
+// aggregateLeaf returns the aggregate of all the KVs of the leaf, which is
+// cached until the leaf is modified.
+func (bt *BTree) aggregateLeaf(l *LeafNode) []byte {
+	if bt.aggregator == nil {
+		return nil
+	}
+	if l.aggregated && l.aggVersion == l.version {
+		return l.agg
+	}
+	l.agg = bt.aggregateKVs(l.Kvs.data[:l.Count])
+	l.aggVersion, l.aggregated = l.version, true
+	return l.agg
+}
+
+// aggregateKVs returns the aggregate of kvs, the aggregate of a KV whose Value
+// is stored out of line and not in memory is the one of its blobRef.
+func (bt *BTree) aggregateKVs(kvs []leafKV) []byte {
+	var agg []byte
+	for _, kv := range kvs {
+		if kv.blob != nil && kv.Value == nil {
+			agg = bt.aggregator.Merge(agg, kv.blob.agg)
+			continue
+		}
+		agg = bt.aggregator.Merge(agg, bt.aggregator.Value(kv.Key, kv.Value))
+	}
+	return agg
+}
+
+// AggregateRange returns the aggregate of the KVs with start <= Key <= end.
+// Only the nodes on the paths to start and end are read, the aggregates of
+// the subtrees in between are taken from their parents.
+func (bt *BTree) AggregateRange(start, end []byte) ([]byte, error) {
+	if bt.aggregator == nil {
+		return nil, ErrNoAggregator
+	}
+	defer bt.evictIfNeeded()
+	bt.lockTree()
+	defer bt.unlockTree()
+
+	return bt.aggregateRange(bt.root, nil, nil, start, end)
+}
+
+// aggregateRange returns the aggregate of the KVs with start <= Key <= end
+// under in, whose Keys are within [lo, hi), a nil bound being unbounded.
+func (bt *BTree) aggregateRange(in *InteriorNode, lo, hi, start, end []byte) ([]byte, error) {
+	if _, _, err := bt.summarize(in); err != nil {
+		return nil, err
+	}
+	var agg []byte
+	for i := 0; i < in.Count; i++ {
+		clo, chi := lo, hi
+		if i > 0 {
+			clo = in.Kcs.data[i-1].Key
+		}
+		if i < in.Count-1 {
+			chi = in.Kcs.data[i].Key
+		}
+		// skip the children out of the range, and take the aggregate of the
+		// children within the range from their KC
+		if (chi != nil && bt.cmpFunc(chi, start) <= 0) || (clo != nil && bt.cmpFunc(clo, end) > 0) {
+			continue
+		}
+		kc := in.Kcs.data[i]
+		if clo != nil && bt.cmpFunc(clo, start) >= 0 && chi != nil && bt.cmpFunc(chi, end) <= 0 {
+			agg = bt.aggregator.Merge(agg, kc.Agg)
+			continue
+		}
+
+		child, err := bt.child(in, i)
+		if err != nil {
+			return nil, err
+		}
+		var part []byte
+		switch c := child.(type) {
+		case *LeafNode:
+			from, _ := c.findSmallest(start)
+			to, ok := c.find(end)
+			if ok {
+				to++
+			}
+			if from < to {
+				part = bt.aggregateKVs(c.Kvs.data[from:to])
+			}
+		case *InteriorNode:
+			if part, err = bt.aggregateRange(c, clo, chi, start, end); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrCorruptNode
+		}
+		agg = bt.aggregator.Merge(agg, part)
+	}
+	return agg, nil
+}
+
+// ProveAggregateRange returns the aggregate of the KVs with start <= Key <= end
+// in the last committed tree, along with a proof of it for the root hash of
+// the tree, to be checked by VerifyAggregateRange.
+func (bt *BTree) ProveAggregateRange(start, end []byte) ([]byte, *Proof, error) {
+	if bt.aggregator == nil {
+		return nil, nil, ErrNoAggregator
+	}
+	bt.lockTree()
+	root := bt.committed
+	bt.unlockTree()
+	if root == nil {
+		return nil, nil, ErrNotCommitted
+	}
+
+	rec := newProofRecorder(bt.db)
+	committed, err := openBTree(rec, root, bt.keyLen, bt.cmpFunc, WithAggregator(bt.aggregator))
+	if err != nil {
+		return nil, nil, err
+	}
+	agg, err := committed.AggregateRange(start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	return agg, rec.proof(), nil
+}
+
+// VerifyAggregateRange checks that agg is the aggregate of the KVs with
+// start <= Key <= end in the tree committed with root, by computing it from
+// the nodes of proof. It returns ErrInvalidProof if it is not.
+func VerifyAggregateRange(root, start, end, agg []byte, proof *Proof, keyLen int, cmpFunc func(key1, key2 []byte) int, a Aggregator) error {
+	bt, err := openBTree(proof.database(), root, keyLen, cmpFunc, WithAggregator(a))
+	if err != nil {
+		return ErrInvalidProof
+	}
+	got, err := bt.AggregateRange(start, end)
+	if err != nil || !bytes.Equal(got, agg) {
+		return ErrInvalidProof
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package bplustree
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// blobRef is the reference to a Value stored out of line, as a blob of the db
+// stored under the hash of the Value. It holds the aggregate of the KV of the
+// Value as well, so that the KV is aggregated without reading the blob.
+type blobRef struct {
+	hash []byte
+	size int
+	agg  []byte
+}
+
+// WithBlobs makes the tree store the Values larger than threshold bytes out of
+// line, as separate blobs of the db addressed by their hash, with the leaves
+// holding only the hash and the size of the Values. The blob of a Value is
+// read when the Value is returned, and not when its leaf is loaded, so that
+// large Values are neither read nor hashed along with the rest of their
+// leaves. The aggregate of a KV whose Value is stored out of line is computed
+// by the Aggregator of the tree before the Value leaves the memory, and kept
+// next to the hash of the Value in the leaf.
+func WithBlobs(threshold int) Option {
+	return func(bt *BTree) {
+		bt.blobThreshold = threshold
+	}
+}
+
+// isBlob reports whether the Value of kv is stored out of line.
+func (bt *BTree) isBlob(kv leafKV) bool {
+	return kv.blob != nil || (bt.blobThreshold > 0 && len(kv.Value) > bt.blobThreshold)
+}
+
+// A leaf whose header has the flagBlobs flag holds tagged Values, which are
+// either
+//
+//	tagInline (1) | Value
+//
+// or, for a Value stored out of line,
+//
+//	tagBlob (1) | hash length (uvarint) | hash | size (uvarint) |
+//	Agg length (uvarint) | Agg
+//
+// where Agg is the aggregate of the KV, empty for a tree without Aggregator.
+const (
+	tagInline = byte(0)
+	tagBlob   = byte(1)
+)
+
+// blobLeaf returns a copy of the leaf holding tagged Values, along with the
+// Values of the leaf to be stored as blobs, or the leaf itself if it has no
+// Value stored out of line. The references to the new blobs are kept in the
+// leaf, so that a Value is hashed and stored as a blob only once, see publish.
+func (bt *BTree) blobLeaf(l *LeafNode) (*LeafNode, [][]byte) {
+	i := 0
+	for i < l.Count && !bt.isBlob(l.Kvs.data[i]) {
+		i++
+	}
+	if i == l.Count {
+		return l, nil
+	}
+
+	var blobs [][]byte
+	c := newLeafNode(nil, l.keyLen, l.Kvs.cmpFunc)
+	c.Count = l.Count
+	for i := 0; i < l.Count; i++ {
+		kv := l.Kvs.data[i]
+		if !bt.isBlob(kv) {
+			c.Kvs.data[i] = leafKV{KV: KV{kv.Key, append([]byte{tagInline}, kv.Value...)}}
+			continue
+		}
+		ref := kv.blob
+		if ref == nil {
+			ref = &blobRef{hash: bt.hasher.sum(kv.Value), size: len(kv.Value)}
+			if bt.aggregator != nil {
+				ref.agg = bt.aggregator.Value(kv.Key, kv.Value)
+			}
+			blobs = append(blobs, kv.Value)
+			l.Kvs.data[i].blob = ref
+		}
+		value := []byte{tagBlob}
+		value = appendUvarint(value, uint64(len(ref.hash)))
+		value = append(value, ref.hash...)
+		value = appendUvarint(value, uint64(ref.size))
+		value = appendUvarint(value, uint64(len(ref.agg)))
+		value = append(value, ref.agg...)
+		c.Kvs.data[i] = leafKV{KV: KV{kv.Key, value}}
+	}
+	return c, blobs
+}
+
+// keepBlobs caches in the leaf l the references to the blobs of c, a copy of
+// l holding the same KVs.
+func keepBlobs(l, c *LeafNode) {
+	for i := 0; i < c.Count; i++ {
+		if ref := c.Kvs.data[i].blob; ref != nil {
+			l.Kvs.data[i].blob = ref
+		}
+	}
+}
+
+// untagLeaf replaces the tagged Values of a decoded leaf by the Values, or by
+// the references to their blobs.
+func untagLeaf(l *LeafNode) error {
+	for i := 0; i < l.Count; i++ {
+		kv := &l.Kvs.data[i]
+		if len(kv.Value) == 0 {
+			return ErrCorruptNode
+		}
+		tag, value := kv.Value[0], kv.Value[1:]
+		switch tag {
+		case tagInline:
+			kv.Value = value
+		case tagBlob:
+			ref := &blobRef{}
+			var err error
+			if ref.hash, value, err = readUvarintBytes(value); err != nil {
+				return err
+			}
+			s, n := binary.Uvarint(value)
+			if n <= 0 || s > 1<<62 {
+				return ErrCorruptNode
+			}
+			ref.size = int(s)
+			if ref.agg, value, err = readUvarintBytes(value[n:]); err != nil {
+				return err
+			}
+			if len(value) != 0 {
+				return ErrCorruptNode
+			}
+			if len(ref.agg) == 0 {
+				ref.agg = nil
+			}
+			kv.Value, kv.blob = nil, ref
+		default:
+			return ErrCorruptNode
+		}
+	}
+	return nil
+}
+
+// readUvarintBytes reads a uvarint length prefixed byte slice from data, it
+// returns the slice and the rest of data.
+func readUvarintBytes(data []byte) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || size > uint64(len(data)-n) {
+		return nil, nil, ErrCorruptNode
+	}
+	end := n + int(size)
+	return data[n:end:end], data[end:], nil
+}
+
+// loadBlob reads the Value stored out of line under ref.
+func (bt *BTree) loadBlob(ref *blobRef) ([]byte, error) {
+	value, err := bt.read(ref.hash, func(value []byte) error {
+		if len(value) != ref.size || !bytes.Equal(bt.hasher.sum(value), ref.hash) {
+			return ErrCorruptNode
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &NodeError{Hash: CopyBytes(ref.hash), Err: err}
+	}
+	return value, nil
+}
+
+// value returns the Value of kv, reading it from its blob if it is stored out
+// of line and not in memory.
+func (bt *BTree) value(kv leafKV) ([]byte, error) {
+	if kv.blob == nil || kv.Value != nil {
+		return kv.Value, nil
+	}
+	return bt.loadBlob(kv.blob)
+}
+
+// resolveKV returns kv with its Value read from its blob if needed, it takes
+// the results of a query returning a single KV.
+func (bt *BTree) resolveKV(kv leafKV, ok bool, err error) (KV, bool, error) {
+	if !ok || err != nil {
+		return KV{}, ok, err
+	}
+	value, err := bt.value(kv)
+	if err != nil {
+		return KV{}, false, err
+	}
+	return KV{kv.Key, value}, true, nil
+}
+
+// loadValues reads the Values of the kvs which are stored out of line and not
+// in memory from their blobs.
+func (bt *BTree) loadValues(kvs []leafKV) error {
+	for i, kv := range kvs {
+		if kv.blob == nil || kv.Value != nil {
+			continue
+		}
+		value, err := bt.loadBlob(kv.blob)
+		if err != nil {
+			return err
+		}
+		kvs[i].Value = value
+	}
+	return nil
+}
+
+// resolvedKVs returns the KVs of kvs, with the Values stored out of line read
+// from their blobs.
+func (bt *BTree) resolvedKVs(kvs []leafKV) ([]KV, error) {
+	if err := bt.loadValues(kvs); err != nil {
+		return nil, err
+	}
+	result := make([]KV, len(kvs))
+	for i, kv := range kvs {
+		result[i] = kv.KV
+	}
+	return result, nil
+}
@@ -1,5 +1,7 @@
 package bplustree
 
+import "encoding/binary"
+
 func Int64ToBytes(i int64) []byte {
 	b := make([]byte, 8)
 
@@ -25,3 +27,18 @@ func Int32ToBytes(i int32) []byte {
 
 	return b
 }
+
+func BytesToInt32(b []byte) int32 {
+	return int32(b[3]) | int32(b[2])<<8 | int32(b[1])<<16 | int32(b[0])<<24
+}
+
+func BytesToInt64(b []byte) int64 {
+	return int64(b[7]) | int64(b[6])<<8 | int64(b[5])<<16 | int64(b[4])<<24 |
+		int64(b[3])<<32 | int64(b[2])<<40 | int64(b[1])<<48 | int64(b[0])<<56
+}
+
+// appendUvarint appends the uvarint encoding of x to b.
+func appendUvarint(b []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], x)]...)
+}
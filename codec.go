@@ -0,0 +1,111 @@
+package bplustree
+
+import "errors"
+
+// ErrInvalidEncoding is returned when a Key or Value can't be decoded.
+var ErrInvalidEncoding = errors.New("bplustree: invalid encoding")
+
+// KeyCodec encodes Keys of type K to the byte Keys of a tree. The encoding must
+// preserve the order of the Keys under the cmpFunc of the tree, which is
+// bytes.Compare for all the codecs below.
+type KeyCodec[K any] interface {
+	EncodeKey(k K) []byte
+	DecodeKey(data []byte) (K, error)
+}
+
+// ValueCodec encodes Values of type V to the byte Values of a tree.
+type ValueCodec[V any] interface {
+	EncodeValue(v V) []byte
+	DecodeValue(data []byte) (V, error)
+}
+
+// Int64Codec encodes int64 Keys and Values as 8 big endian bytes, with the
+// sign bit flipped so that negative Keys sort before positive ones.
+type Int64Codec struct{}
+
+func (Int64Codec) EncodeKey(k int64) []byte { return Int64ToBytes(k ^ -1<<63) }
+
+func (Int64Codec) DecodeKey(data []byte) (int64, error) {
+	if len(data) != 8 {
+		return 0, ErrInvalidEncoding
+	}
+	return BytesToInt64(data) ^ -1<<63, nil
+}
+
+func (c Int64Codec) EncodeValue(v int64) []byte { return c.EncodeKey(v) }
+
+func (c Int64Codec) DecodeValue(data []byte) (int64, error) { return c.DecodeKey(data) }
+
+// Uint64Codec encodes uint64 Keys and Values as 8 big endian bytes.
+type Uint64Codec struct{}
+
+func (Uint64Codec) EncodeKey(k uint64) []byte { return Int64ToBytes(int64(k)) }
+
+func (Uint64Codec) DecodeKey(data []byte) (uint64, error) {
+	if len(data) != 8 {
+		return 0, ErrInvalidEncoding
+	}
+	return uint64(BytesToInt64(data)), nil
+}
+
+func (c Uint64Codec) EncodeValue(v uint64) []byte { return c.EncodeKey(v) }
+
+func (c Uint64Codec) DecodeValue(data []byte) (uint64, error) { return c.DecodeKey(data) }
+
+// StringCodec encodes string Keys and Values as their bytes, the Keys sort
+// like the strings themselves. String Keys are limited to the Key length of
+// the tree.
+type StringCodec struct{}
+
+func (StringCodec) EncodeKey(k string) []byte { return []byte(k) }
+
+func (StringCodec) DecodeKey(data []byte) (string, error) { return string(data), nil }
+
+func (StringCodec) EncodeValue(v string) []byte { return []byte(v) }
+
+func (StringCodec) DecodeValue(data []byte) (string, error) { return string(data), nil }
+
+// BytesCodec stores byte slice Values as is.
+type BytesCodec struct{}
+
+func (BytesCodec) EncodeKey(k []byte) []byte { return k }
+
+func (BytesCodec) DecodeKey(data []byte) ([]byte, error) { return data, nil }
+
+func (BytesCodec) EncodeValue(v []byte) []byte { return v }
+
+func (BytesCodec) DecodeValue(data []byte) ([]byte, error) { return data, nil }
+
+// Bytes16Codec encodes 16 byte arrays, such as UUIDs, as is.
+type Bytes16Codec struct{}
+
+func (Bytes16Codec) EncodeKey(k [16]byte) []byte { return k[:] }
+
+func (Bytes16Codec) DecodeKey(data []byte) (k [16]byte, err error) {
+	if len(data) != len(k) {
+		return k, ErrInvalidEncoding
+	}
+	copy(k[:], data)
+	return k, nil
+}
+
+func (c Bytes16Codec) EncodeValue(v [16]byte) []byte { return c.EncodeKey(v) }
+
+func (c Bytes16Codec) DecodeValue(data []byte) ([16]byte, error) { return c.DecodeKey(data) }
+
+// Bytes32Codec encodes 32 byte arrays, such as hashes, as is.
+type Bytes32Codec struct{}
+
+func (Bytes32Codec) EncodeKey(k [32]byte) []byte { return k[:] }
+
+func (Bytes32Codec) DecodeKey(data []byte) (k [32]byte, err error) {
+	if len(data) != len(k) {
+		return k, ErrInvalidEncoding
+	}
+	copy(k[:], data)
+	return k, nil
+}
+
+func (c Bytes32Codec) EncodeValue(v [32]byte) []byte { return c.EncodeKey(v) }
+
+func (c Bytes32Codec) DecodeValue(data []byte) ([32]byte, error) { return c.DecodeKey(data) }
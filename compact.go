@@ -0,0 +1,212 @@
+package bplustree
+
+import "encoding/binary"
+
+// The compact encoding of a node is
+//
+//	prefix (1) | count (uvarint) | entries
+//
+// where the entry of a KV is
+//
+//	shared (uvarint) | suffix length (uvarint) | suffix | Value length (uvarint) | Value
+//
+// and the entry of a KC is
+//
+//	shared (uvarint) | suffix length (uvarint) | suffix | hash length (uvarint) | hash |
+//	Size (uvarint) | Agg length (uvarint) | Agg
+//
+// The Key of an entry is the first shared bytes of the Key of the previous
+// entry followed by the suffix, the Key of the first entry is stored whole.
+
+// compactWriter writes the compact encoding of a node.
+type compactWriter struct {
+	data []byte
+	prev []byte
+}
+
+func newCompactWriter(prefix byte, count int) *compactWriter {
+	w := &compactWriter{data: []byte{prefix}}
+	w.uvarint(uint64(count))
+	return w
+}
+
+func (w *compactWriter) uvarint(x uint64) {
+	w.data = appendUvarint(w.data, x)
+}
+
+func (w *compactWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.data = append(w.data, b...)
+}
+
+// key starts the entry of key.
+func (w *compactWriter) key(key []byte) {
+	shared := 0
+	for shared < len(key) && shared < len(w.prev) && key[shared] == w.prev[shared] {
+		shared++
+	}
+	w.uvarint(uint64(shared))
+	w.bytes(key[shared:])
+	w.prev = key
+}
+
+func (w *compactWriter) finish() []byte {
+	return w.data
+}
+
+// compactReader reads the compact encoding of a node. The first error is
+// kept in err, and the reads return zero values from then on.
+type compactReader struct {
+	data  []byte
+	pos   int
+	prev  []byte
+	count int
+	err   error
+}
+
+func newCompactReader(data []byte, prefix byte, max int) *compactReader {
+	r := &compactReader{data: data, pos: 1}
+	if len(data) == 0 || data[0] != prefix {
+		r.err = ErrCorruptNode
+		return r
+	}
+	count := r.uvarint()
+	if r.err != nil || count > uint64(max) {
+		r.err = ErrCorruptNode
+		return r
+	}
+	r.count = int(count)
+	return r
+}
+
+func (r *compactReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		r.err = ErrCorruptNode
+		return 0
+	}
+	r.pos += n
+	return x
+}
+
+func (r *compactReader) bytes() []byte {
+	size := r.uvarint()
+	if r.err != nil || size > uint64(len(r.data)-r.pos) {
+		r.err = ErrCorruptNode
+		return nil
+	}
+	b := r.data[r.pos : r.pos+int(size) : r.pos+int(size)]
+	r.pos += int(size)
+	return b
+}
+
+// key reads the Key of the next entry. The Keys stored whole alias the
+// encoding, the others are copied.
+func (r *compactReader) key() []byte {
+	if r.err != nil {
+		return nil
+	}
+	shared := r.uvarint()
+	suffix := r.bytes()
+	if r.err != nil || shared > uint64(len(r.prev)) {
+		r.err = ErrCorruptNode
+		return nil
+	}
+	key := suffix
+	if shared > 0 {
+		key = make([]byte, 0, int(shared)+len(suffix))
+		key = append(append(key, r.prev[:shared]...), suffix...)
+	}
+	r.prev = key
+	return key
+}
+
+// finish returns the error of the reads, if any, or ErrCorruptNode if the
+// encoding was not read to the end.
+func (r *compactReader) finish() error {
+	if r.err == nil && r.pos != len(r.data) {
+		return ErrCorruptNode
+	}
+	return r.err
+}
+
+// compactCodec encodes the nodes in CompactEncoding.
+type compactCodec struct{}
+
+func (compactCodec) encodeLeaf(l *LeafNode) []byte { return l.encodeCompact() }
+
+func (compactCodec) decodeLeaf(l *LeafNode, data []byte) error { return l.decodeCompact(data) }
+
+func (compactCodec) encodeInterior(in *InteriorNode) []byte { return in.encodeCompact() }
+
+func (compactCodec) decodeInterior(in *InteriorNode, data []byte) error {
+	return in.decodeCompact(data)
+}
+
+// encodeCompact returns the compact encoding of the leaf.
+func (l *LeafNode) encodeCompact() []byte {
+	w := newCompactWriter(prefixLeaf, l.Count)
+	for i := 0; i < l.Count; i++ {
+		kv := l.Kvs.data[i]
+		w.key(kv.Key)
+		w.bytes(kv.Value)
+	}
+	return w.finish()
+}
+
+func (l *LeafNode) decodeCompact(data []byte) error {
+	r := newCompactReader(data, prefixLeaf, MaxKV)
+	for i := 0; i < r.count && r.err == nil; i++ {
+		kv := &l.Kvs.data[i]
+		kv.Key = r.key()
+		kv.Value = r.bytes()
+	}
+	if err := r.finish(); err != nil {
+		return err
+	}
+	l.Count = r.count
+	l.cacheData = data
+	l.dirty = false
+	return nil
+}
+
+// encodeCompact returns the compact encoding of the interior node.
+func (in *InteriorNode) encodeCompact() []byte {
+	w := newCompactWriter(prefixInterior, in.Count)
+	for i := 0; i < in.Count; i++ {
+		kc := in.Kcs.data[i]
+		_, childHash, _ := kc.Child.cache()
+		w.key(kc.Key)
+		w.bytes(childHash)
+		w.uvarint(uint64(kc.Size))
+		w.bytes(kc.Agg)
+	}
+	return w.finish()
+}
+
+func (in *InteriorNode) decodeCompact(data []byte) error {
+	r := newCompactReader(data, prefixInterior, MaxKC)
+	if r.err == nil && r.count < 1 {
+		return ErrCorruptNode
+	}
+	for i := 0; i < r.count && r.err == nil; i++ {
+		kc := &in.Kcs.data[i]
+		kc.Key = r.key()
+		hash := r.bytes()
+		kc.Size = int(r.uvarint())
+		if kc.Agg = r.bytes(); len(kc.Agg) == 0 {
+			kc.Agg = nil
+		}
+		kc.Child = newHashNode(in, hash, in.keyLen)
+	}
+	if err := r.finish(); err != nil {
+		return err
+	}
+	in.Count = r.count
+	in.cacheData = data
+	in.dirty = false
+	return nil
+}
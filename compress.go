@@ -0,0 +1,133 @@
+package bplustree
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// Compression identifies the compression of the encoding of the stored
+// nodes.
+type Compression byte
+
+const (
+	// NoCompression stores the encoding of the nodes as is.
+	NoCompression Compression = iota
+
+	// FlateCompression compresses the encoding of the nodes with DEFLATE.
+	FlateCompression
+)
+
+func (c Compression) known() bool { return c == NoCompression || c == FlateCompression }
+
+// DefaultCompressionThreshold is the size of the encoding of a node below
+// which it is stored uncompressed, see WithCompression.
+const DefaultCompressionThreshold = 512
+
+// WithCompression makes the tree compress the encoding of the nodes it stores
+// with c, unless the encoding is smaller than threshold bytes or doesn't
+// shrink once compressed. The compression of a node is a matter of storage
+// only: the hash of a node is the hash of its uncompressed form, see
+// canonicalNode, so the hashes of a tree and its proofs are the same whether
+// its nodes are compressed or not. c must be one of the Compressions above,
+// Commit and Migrate fail with ErrUnsupportedFormat otherwise.
+func WithCompression(c Compression, threshold int) Option {
+	return func(bt *BTree) {
+		bt.compression = c
+		bt.compressThreshold = threshold
+	}
+}
+
+// The compressed form of a node is its header, with the compression byte set,
+// followed by
+//
+//	size (uvarint) | compressed encoding
+//
+// where size is the size of the uncompressed encoding.
+
+// flateWriters holds the flate.Writers reused by compressNode, allocating one
+// takes far more memory than the nodes it compresses.
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// compressNode returns the stored form of data, the uncompressed form of a
+// node returned by encodeNode.
+func (bt *BTree) compressNode(data []byte) []byte {
+	if bt.compression == NoCompression || len(data)-headerSize < bt.compressThreshold {
+		return data
+	}
+	payload := data[headerSize:]
+
+	var buf bytes.Buffer
+	buf.Write(data[:headerSize])
+	buf.Bytes()[compressionOffset] = byte(bt.compression)
+	buf.Write(appendUvarint(nil, uint64(len(payload))))
+
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(&buf)
+	w.Write(payload)
+	w.Close()
+	flateWriters.Put(w)
+	if buf.Len() >= len(data) {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// decompress returns the uncompressed encoding of a node from the payload
+// following its header.
+func decompress(c Compression, payload []byte) ([]byte, error) {
+	if c == NoCompression {
+		return payload, nil
+	}
+	size, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return nil, ErrCorruptNode
+	}
+
+	// the size is checked against the data read, not trusted for allocation
+	var buf bytes.Buffer
+	r := flate.NewReader(bytes.NewReader(payload[n:]))
+	if _, err := io.Copy(&buf, io.LimitReader(r, int64(size)+1)); err != nil {
+		return nil, ErrCorruptNode
+	}
+	if uint64(buf.Len()) != size {
+		return nil, ErrCorruptNode
+	}
+	return buf.Bytes(), nil
+}
+
+// canonicalNode returns the uncompressed form of a stored node, which is the
+// representation the hash of the node is computed over: the header of the
+// node with the compression byte cleared, followed by the uncompressed
+// encoding of the node. The nodes of the versions before the compression
+// byte are their own canonical form.
+func canonicalNode(data []byte) ([]byte, error) {
+	h, payload, err := readHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	payload, err = decompress(h.compression, payload)
+	if err != nil {
+		return nil, err
+	}
+	return canonicalForm(data, h, payload), nil
+}
+
+// canonicalForm returns the canonical form of the stored node data, whose
+// header is h and whose uncompressed encoding is payload.
+func canonicalForm(data []byte, h nodeHeader, payload []byte) []byte {
+	if h.compression == NoCompression {
+		return data
+	}
+	canonical := make([]byte, 0, headerSize+len(payload))
+	canonical = append(canonical, data[:headerSize]...)
+	canonical[compressionOffset] = byte(NoCompression)
+	return append(canonical, payload...)
+}
@@ -0,0 +1,303 @@
+package bplustree
+
+import "bytes"
+
+// keyRange is the range of Keys from start to end, end excluded unless the
+// range is closed. A nil bound leaves the range unbounded on its side. The
+// range of a prefix only holds the Keys starting with start, which the Keys
+// deleted from the leaves are checked against.
+type keyRange struct {
+	start  []byte
+	end    []byte
+	closed bool
+	prefix bool
+}
+
+const (
+	rangeStart  = 1 << 0
+	rangeEnd    = 1 << 1
+	rangeClosed = 1 << 2
+	rangePrefix = 1 << 3
+)
+
+// encode encodes the range as the key and value of a WAL op.
+func (r keyRange) encode() (key, value []byte) {
+	var flags byte
+	if r.start != nil {
+		flags |= rangeStart
+	}
+	if r.end != nil {
+		flags |= rangeEnd
+	}
+	if r.closed {
+		flags |= rangeClosed
+	}
+	if r.prefix {
+		flags |= rangePrefix
+	}
+	return r.start, append([]byte{flags}, r.end...)
+}
+
+func decodeKeyRange(key, value []byte) (keyRange, error) {
+	if len(value) == 0 {
+		return keyRange{}, errInvalidRecord
+	}
+	r := keyRange{closed: value[0]&rangeClosed != 0, prefix: value[0]&rangePrefix != 0}
+	if value[0]&rangeStart != 0 {
+		r.start = CopyBytes(key)
+	}
+	if value[0]&rangeEnd != 0 {
+		r.end = CopyBytes(value[1:])
+	}
+	return r, nil
+}
+
+// disjoint reports whether the range holds none of the Keys in [lo, hi).
+func (r keyRange) disjoint(lo, hi []byte, cmp func(key1, key2 []byte) int) bool {
+	if r.start != nil && hi != nil && cmp(hi, r.start) <= 0 {
+		return true
+	}
+	if r.end == nil || lo == nil {
+		return false
+	}
+	if r.closed {
+		return cmp(lo, r.end) > 0
+	}
+	return cmp(lo, r.end) >= 0
+}
+
+// covers reports whether the range holds all the Keys in [lo, hi).
+func (r keyRange) covers(lo, hi []byte, cmp func(key1, key2 []byte) int) bool {
+	if r.start != nil && (lo == nil || cmp(lo, r.start) < 0) {
+		return false
+	}
+	return r.end == nil || (hi != nil && cmp(hi, r.end) <= 0)
+}
+
+// DeleteRange deletes all the Keys with start <= Key <= end, and returns the
+// number of Keys deleted. A nil start or end leaves the range unbounded on
+// its side. The subtrees holding only Keys in the range are unlinked at once,
+// without being loaded, so that only the two boundary paths are read. A node
+// that fails to load stops the deletion, with the Keys deleted so far left
+// deleted and the nodes on the boundary paths possibly underfilled.
+func (bt *BTree) DeleteRange(start, end []byte) (int, error) {
+	defer bt.evictIfNeeded()
+	bt.lockTree()
+	defer bt.unlockTree()
+
+	return bt.deleteLogged(keyRange{start: start, end: end, closed: true})
+}
+
+// deleteLogged logs the deletion of the Keys in r and deletes them.
+func (bt *BTree) deleteLogged(r keyRange) (int, error) {
+	if len(r.start) > bt.keyLen || len(r.end) > bt.keyLen {
+		return 0, ErrKeyTooLong
+	}
+	key, value := r.encode()
+	if err := bt.log(walDeleteRange, key, value); err != nil {
+		return 0, err
+	}
+	return bt.deleteRange(r)
+}
+
+// deleteRange deletes all the Keys in r and returns the number of Keys
+// deleted. The subtrees holding only Keys in r are dropped without being
+// loaded, so that only the nodes on the paths to the two bounds of r are
+// read and rebalanced. A node that fails to load stops the deletion, leaving
+// the Keys deleted so far deleted. The tree must be locked.
+func (bt *BTree) deleteRange(r keyRange) (int, error) {
+	removed, err := bt.deleteFrom(bt.root, nil, nil, r)
+	if err != nil {
+		return removed, err
+	}
+
+	for bt.root.Count == 1 {
+		child, ok := bt.root.Kcs.data[0].Child.(*InteriorNode)
+		if !ok {
+			break
+		}
+		bt.touch(child)
+		child.setParent(nil)
+		bt.root = child
+		bt.addNodes(0, -1)
+		bt.height--
+	}
+	return removed, nil
+}
+
+// deleteFrom deletes the Keys in r from the subtree of in, whose Keys are in
+// [lo, hi), then rebalances the children of in left underflowed.
+func (bt *BTree) deleteFrom(in *InteriorNode, lo, hi []byte, r keyRange) (int, error) {
+	// the Sizes of the dropped subtrees are the number of Keys deleted
+	if _, _, err := bt.summarize(in); err != nil {
+		return 0, err
+	}
+	bt.touch(in)
+
+	removed, changed := 0, false
+	for i := 0; i < in.Count; {
+		clo, chi := lo, hi
+		if i > 0 {
+			clo = in.Kcs.data[i-1].Key
+		}
+		if i < in.Count-1 {
+			chi = in.Kcs.data[i].Key
+		}
+
+		if r.disjoint(clo, chi, bt.cmpFunc) {
+			i++
+			continue
+		}
+		// the subtrees of a prefix range are only dropped when their lower
+		// bound starts with the prefix too
+		if r.covers(clo, chi, bt.cmpFunc) && in.Count > 1 && (!r.prefix || bytes.HasPrefix(clo, r.start)) {
+			removed += in.Kcs.data[i].Size
+			bt.drop(in, i)
+			changed = true
+			continue
+		}
+
+		child, err := bt.child(in, i)
+		if err != nil {
+			return removed, bt.deleted(in, changed, err)
+		}
+		version := versionOf(child)
+		var n int
+		switch c := child.(type) {
+		case *LeafNode:
+			n = bt.trimLeaf(c, r)
+		case *InteriorNode:
+			n, err = bt.deleteFrom(c, clo, chi, r)
+		default:
+			err = ErrCorruptNode
+		}
+		removed += n
+		changed = changed || versionOf(child) != version
+		if err != nil {
+			return removed, bt.deleted(in, changed, err)
+		}
+		i++
+	}
+	if !changed {
+		return 0, nil
+	}
+	in.setDirty(true)
+	return removed, bt.rebalanceChildren(in)
+}
+
+// rebalanceChildren rebalances every loaded child of in left underflowed.
+func (bt *BTree) rebalanceChildren(in *InteriorNode) error {
+	for i := 0; i < in.Count && in.Count > 1; {
+		if !underflow(in.Kcs.data[i].Child) {
+			i++
+			continue
+		}
+		if err := bt.rebalance(in, i); err != nil {
+			return err
+		}
+		if i > 0 {
+			i--
+		}
+	}
+	return nil
+}
+
+// deleted marks in dirty if the deletion has changed its subtree, and
+// returns err.
+func (bt *BTree) deleted(in *InteriorNode, changed bool, err error) error {
+	if changed {
+		in.setDirty(true)
+	}
+	return err
+}
+
+// drop removes the child at index i of in along with its whole subtree, whose
+// range of Keys is merged into the next child, or into the previous one when
+// it is the last child.
+func (bt *BTree) drop(in *InteriorNode, i int) {
+	n := in.Kcs.data[i].Child
+
+	// chain the leaves around the subtree to each other
+	prev, next := loadedLeaf(n, -1), loadedLeaf(n, 1)
+	if prev != nil {
+		bt.touch(prev)
+		prev.next = next
+	}
+	if next != nil {
+		bt.touch(next)
+		next.prev = prev
+	}
+	if bt.first != nil && (Node(bt.first) == n || isAncestor(n, bt.first)) {
+		bt.first = next
+	}
+	leaves, interiors := countLoaded(n)
+	bt.addNodes(-leaves, -interiors)
+
+	if i == in.Count-1 {
+		in.Kcs.data[i-1].Key = in.Kcs.data[i].Key
+	}
+	in.remove(i)
+}
+
+// trimLeaf deletes the KVs in r from the leaf and returns their number.
+func (bt *BTree) trimLeaf(leaf *LeafNode, r keyRange) int {
+	if r.prefix {
+		return bt.trimLeafPrefix(leaf, r)
+	}
+	from, to := 0, leaf.Count
+	if r.start != nil {
+		from, _ = leaf.findSmallest(r.start)
+	}
+	if r.end != nil {
+		var found bool
+		if to, found = leaf.find(r.end); found && r.closed {
+			to++
+		}
+	}
+	if from >= to {
+		return 0
+	}
+
+	bt.touch(leaf)
+	copy(leaf.Kvs.data[from:], leaf.Kvs.data[to:leaf.Count])
+	clearKVs(leaf.Kvs.data, leaf.Count-(to-from), leaf.Count)
+	leaf.Count -= to - from
+	leaf.setDirty(true)
+	return to - from
+}
+
+// trimLeafPrefix deletes the KVs in the range r of a prefix from the leaf, only
+// the ones whose Key starts with the prefix, and returns their number.
+func (bt *BTree) trimLeafPrefix(leaf *LeafNode, r keyRange) int {
+	from, to := 0, leaf.Count
+	if r.start != nil {
+		from, _ = leaf.findSmallest(r.start)
+	}
+	if r.end != nil {
+		to, _ = leaf.find(r.end)
+	}
+
+	removed := 0
+	for i := from; i < to; i++ {
+		if bytes.HasPrefix(leaf.Kvs.data[i].Key, r.start) {
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0
+	}
+
+	bt.touch(leaf)
+	kept := from
+	for i := from; i < leaf.Count; i++ {
+		if i < to && bytes.HasPrefix(leaf.Kvs.data[i].Key, r.start) {
+			continue
+		}
+		leaf.Kvs.data[kept] = leaf.Kvs.data[i]
+		kept++
+	}
+	clearKVs(leaf.Kvs.data, kept, leaf.Count)
+	leaf.Count = kept
+	leaf.setDirty(true)
+	return removed
+}
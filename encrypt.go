@@ -0,0 +1,204 @@
+package bplustree
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+)
+
+// An encrypted value is stored as
+//
+//	key id (4) | nonce (12) | AES-GCM ciphertext and tag
+//
+// where the key id names the key which encrypted the value, and the nonce is
+// drawn at random for each value written. The db key under which the value is
+// stored is the additional data of the encryption, so that a value can't be
+// moved under another key without failing to decrypt.
+const keyIDSize = 4
+
+// EncryptedDatabase is a Database which encrypts the values it writes to
+// another Database with AES-GCM, and decrypts the values it reads. The keys
+// are left as they are: the nodes of a tree stored through an
+// EncryptedDatabase are still addressed by the hashes of their plaintext, so
+// the root hashes of the tree don't depend on the encryption. The proofs made
+// by a tree reading through the EncryptedDatabase hold the plaintext nodes,
+// and are verified against the root hash as usual by whoever they are given
+// to.
+//
+// An EncryptedDatabase writes with a single key, and reads the values
+// encrypted with it or with any of its old keys. To rotate the key, open the
+// db with the new key and the old one, Reencrypt the values of the db, and
+// drop the old key.
+type EncryptedDatabase struct {
+	db   Database
+	id   []byte
+	aead cipher.AEAD
+	byID map[string]cipher.AEAD
+}
+
+// NewEncryptedDatabase returns an EncryptedDatabase writing to db with key,
+// and reading the values encrypted with key or with one of the oldKeys. The
+// keys are AES keys, of 16, 24 or 32 bytes.
+func NewEncryptedDatabase(db Database, key []byte, oldKeys ...[]byte) (*EncryptedDatabase, error) {
+	e := &EncryptedDatabase{db: db, byID: make(map[string]cipher.AEAD)}
+	for _, k := range append([][]byte{key}, oldKeys...) {
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		id := keyID(k)
+		if e.aead == nil {
+			e.id, e.aead = id, aead
+		}
+		e.byID[string(id)] = aead
+	}
+	return e, nil
+}
+
+// keyID returns the id of key stored along with the values it encrypts.
+func keyID(key []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("bplustree key id"))
+	h.Write(key)
+	return h.Sum(nil)[:keyIDSize]
+}
+
+// seal returns the encryption of value stored under key.
+func (e *EncryptedDatabase) seal(key, value []byte) ([]byte, error) {
+	size := keyIDSize + e.aead.NonceSize()
+	data := make([]byte, size, size+len(value)+e.aead.Overhead())
+	copy(data, e.id)
+	nonce := data[keyIDSize:size]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return e.aead.Seal(data, nonce, value, key), nil
+}
+
+// open returns the value whose encryption is stored under key, and whether it
+// is encrypted with the current key.
+func (e *EncryptedDatabase) open(key, data []byte) ([]byte, bool, error) {
+	if len(data) < keyIDSize {
+		return nil, false, ErrDecrypt
+	}
+	aead, ok := e.byID[string(data[:keyIDSize])]
+	if !ok || len(data) < keyIDSize+aead.NonceSize() {
+		return nil, false, ErrDecrypt
+	}
+	nonce := data[keyIDSize : keyIDSize+aead.NonceSize()]
+	value, err := aead.Open(nil, nonce, data[keyIDSize+aead.NonceSize():], key)
+	if err != nil {
+		return nil, false, ErrDecrypt
+	}
+	return value, bytes.Equal(data[:keyIDSize], e.id), nil
+}
+
+func (e *EncryptedDatabase) Put(key, value []byte) error {
+	data, err := e.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return e.db.Put(key, data)
+}
+
+func (e *EncryptedDatabase) Get(key []byte) ([]byte, error) {
+	data, err := e.db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	value, _, err := e.open(key, data)
+	return value, err
+}
+
+func (e *EncryptedDatabase) Has(key []byte) (bool, error) { return e.db.Has(key) }
+
+func (e *EncryptedDatabase) Delete(key []byte) error { return e.db.Delete(key) }
+
+func (e *EncryptedDatabase) Close() { e.db.Close() }
+
+func (e *EncryptedDatabase) NewBatch() Batch {
+	return &encryptedBatch{e: e, batch: e.db.NewBatch()}
+}
+
+// Reencrypt rewrites the values stored under keys which are encrypted with an
+// old key, encrypting them with the current key. The keys of the nodes of a
+// tree, and of its blobs, are listed by Reachable. Reencrypt fails on a value
+// it can't decrypt, leaving the values rewritten so far encrypted with the
+// current key, so it can be run again.
+func (e *EncryptedDatabase) Reencrypt(keys [][]byte) error {
+	batch := e.NewBatch()
+	for _, key := range keys {
+		var value []byte
+		var current bool
+		data, err := e.db.Get(key)
+		if err == nil {
+			value, current, err = e.open(key, data)
+		}
+		if err != nil {
+			return &NodeError{Hash: CopyBytes(key), Err: err}
+		}
+		if current {
+			continue
+		}
+		if err := batch.Put(key, value); err != nil {
+			return err
+		}
+		if batch.ValueSize() >= migrateBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	return batch.Write()
+}
+
+// encryptedBatch encrypts the values put in a batch of the underlying db.
+type encryptedBatch struct {
+	e     *EncryptedDatabase
+	batch Batch
+}
+
+func (b *encryptedBatch) Put(key, value []byte) error {
+	data, err := b.e.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return b.batch.Put(key, data)
+}
+
+func (b *encryptedBatch) Delete(key []byte) error { return b.batch.Delete(key) }
+
+func (b *encryptedBatch) ValueSize() int { return b.batch.ValueSize() }
+
+func (b *encryptedBatch) Write() error { return b.batch.Write() }
+
+func (b *encryptedBatch) Reset() { b.batch.Reset() }
+
+// Replay replays the decrypted contents of the batch into w.
+func (b *encryptedBatch) Replay(w Writer) error {
+	return b.batch.Replay(&decryptingWriter{e: b.e, w: w})
+}
+
+// decryptingWriter decrypts the values written to w.
+type decryptingWriter struct {
+	e *EncryptedDatabase
+	w Writer
+}
+
+func (d *decryptingWriter) Put(key, data []byte) error {
+	value, _, err := d.e.open(key, data)
+	if err != nil {
+		return err
+	}
+	return d.w.Put(key, value)
+}
+
+func (d *decryptingWriter) Delete(key []byte) error { return d.w.Delete(key) }
@@ -0,0 +1,103 @@
+package bplustree
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrKeyTooLong is returned when a Key is longer than the Key length of
+	// the tree.
+	ErrKeyTooLong = errors.New("bplustree: key too long")
+
+	// ErrCorruptNode is returned when a node can't be decoded, doesn't hash
+	// to the hash it is stored under, or when the tree holds a node it
+	// doesn't know about. The corrupt nodes read by a tree are reported as a
+	// CorruptNodeError, which matches ErrCorruptNode with errors.Is.
+	ErrCorruptNode = errors.New("bplustree: corrupt node")
+
+	// ErrUnsupportedFormat is returned when a node is stored in a format
+	// version, or with a hasher, a capacity or a compression, the tree doesn't
+	// support.
+	ErrUnsupportedFormat = errors.New("bplustree: unsupported node format")
+
+	// ErrDecrypt is returned by an EncryptedDatabase for a value it can't
+	// decrypt, because it is encrypted with a key it doesn't hold or it has
+	// been altered.
+	ErrDecrypt = errors.New("bplustree: failed to decrypt value")
+
+	// ErrMissingNode is returned when a node referenced by the tree is not
+	// in the db.
+	ErrMissingNode = errors.New("bplustree: missing node")
+
+	// ErrPrefixOrder is returned by the prefix operations on a tree which is
+	// not ordered by bytes.Compare and has no PrefixSuccessor.
+	ErrPrefixOrder = errors.New("bplustree: no prefix successor for the order of the tree")
+
+	// ErrOutOfRange is returned by Select for an index out of the range of
+	// the Keys of the tree.
+	ErrOutOfRange = errors.New("bplustree: index out of range")
+
+	// ErrNoAggregator is returned by the aggregate queries on a tree created
+	// without an Aggregator.
+	ErrNoAggregator = errors.New("bplustree: tree has no aggregator")
+
+	// ErrNotCommitted is returned when a query on the committed tree is made
+	// on a tree which has never been committed.
+	ErrNotCommitted = errors.New("bplustree: tree has never been committed")
+
+	// ErrInvalidProof is returned when a proof doesn't prove the result of a
+	// query for a root hash.
+	ErrInvalidProof = errors.New("bplustree: invalid proof")
+
+	// ErrInvalidCursor is returned by NextPage for a cursor it has not
+	// returned.
+	ErrInvalidCursor = errors.New("bplustree: invalid cursor")
+
+	// ErrOverlap is returned by Join when the Keys of the left tree are not
+	// all smaller than the Keys of the right tree.
+	ErrOverlap = errors.New("bplustree: key ranges of the trees overlap")
+
+	// ErrSameTree is returned by Join when a tree is joined with itself.
+	ErrSameTree = errors.New("bplustree: tree joined with itself")
+
+	// ErrIncompatibleTrees is returned by Join for trees which don't share
+	// their db, Key length and cmpFunc.
+	ErrIncompatibleTrees = errors.New("bplustree: trees with different db, key length or cmpFunc")
+
+	// ErrTxInProgress is returned by Begin when a transaction is already in
+	// progress on the tree, and by Split and Join while one is.
+	ErrTxInProgress = errors.New("bplustree: transaction already in progress")
+
+	// ErrTxDone is returned when a transaction is used after it has been
+	// committed or rolled back.
+	ErrTxDone = errors.New("bplustree: transaction has already been committed or rolled back")
+)
+
+// NodeError records the hash of the node that failed to load, Err is one of
+// ErrCorruptNode, ErrUnsupportedFormat, ErrMissingNode or the error of the db.
+// A corrupt node read by a tree is reported as a CorruptNodeError instead.
+type NodeError struct {
+	Hash []byte
+	Err  error
+}
+
+func (e *NodeError) Error() string {
+	return fmt.Sprintf("bplustree: node %x: %v", e.Hash, e.Err)
+}
+
+func (e *NodeError) Unwrap() error { return e.Err }
+
+// CorruptNodeError records the hash of a corrupt node read by a tree, and the
+// path to it: the hashes of the nodes from the root down to its parent, nil
+// for a node modified since it was loaded, empty for the root.
+type CorruptNodeError struct {
+	Hash []byte
+	Path [][]byte
+}
+
+func (e *CorruptNodeError) Error() string {
+	return fmt.Sprintf("bplustree: corrupt node %x, path %x", e.Hash, e.Path)
+}
+
+func (e *CorruptNodeError) Is(target error) bool { return target == ErrCorruptNode }
@@ -0,0 +1,229 @@
+package bplustree
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// WithMemoryLimit caps the memory used by the loaded nodes of the tree to
+// about limit bytes, measured by the encoded size of the nodes. Once the
+// limit is exceeded, the least recently used clean subtrees are unloaded,
+// leaving their hashes in their parents, and are loaded again from db when
+// they are needed. Dirty nodes are never unloaded, so the limit can only be
+// enforced up to the nodes modified since the last commit.
+func WithMemoryLimit(limit int) Option {
+	return func(bt *BTree) {
+		bt.memLimit = int64(limit)
+	}
+}
+
+// use stamps n as used by the running operation.
+func (bt *BTree) use(n Node) {
+	if bt.memLimit == 0 {
+		return
+	}
+	switch node := n.(type) {
+	case *LeafNode:
+		atomic.StoreUint64(&node.used, atomic.AddUint64(&bt.clock, 1))
+	case *InteriorNode:
+		atomic.StoreUint64(&node.used, atomic.AddUint64(&bt.clock, 1))
+	}
+}
+
+func usedOf(n Node) uint64 {
+	switch node := n.(type) {
+	case *LeafNode:
+		return atomic.LoadUint64(&node.used)
+	case *InteriorNode:
+		return atomic.LoadUint64(&node.used)
+	default:
+		return 0
+	}
+}
+
+// nodeSize estimates the memory used by a loaded node with its encoded size.
+func nodeSize(n Node) int64 {
+	if dirty, _, data := n.cache(); !dirty && data != nil {
+		return int64(len(data))
+	}
+	switch node := n.(type) {
+	case *LeafNode:
+		return int64(node.MsgSize())
+	case *InteriorNode:
+		return int64(5 + node.Count*(8+node.keyLen+32))
+	default:
+		return 0
+	}
+}
+
+// evictIfNeeded unloads nodes if the estimated memory used by the loaded
+// nodes exceeds the limit. As the dirty nodes can't be unloaded, it waits
+// for a quarter of the limit to be loaded since the last eviction before
+// walking the tree again. It must be called once the operation is over and
+// has released the tree.
+func (bt *BTree) evictIfNeeded() {
+	if bt.memLimit == 0 {
+		return
+	}
+	loaded := atomic.LoadInt64(&bt.loaded)
+	if loaded <= bt.memLimit || loaded <= atomic.LoadInt64(&bt.kept)+bt.memLimit/4 {
+		return
+	}
+	bt.trim()
+}
+
+// trim measures the memory used by the loaded nodes, which are unloaded if it
+// exceeds the limit.
+func (bt *BTree) trim() {
+	if bt.memLimit == 0 {
+		return
+	}
+	bt.lockTree()
+	defer bt.unlockTree()
+
+	// the nodes saved by a transaction must stay in the tree
+	if bt.tx != nil {
+		return
+	}
+	bt.evict(bt.memLimit * 3 / 4)
+}
+
+type evictCandidate struct {
+	node   Node
+	parent *InteriorNode
+	used   uint64
+}
+
+// evict unloads the least recently used clean subtrees until the loaded nodes
+// fit in target bytes. The tree must be locked.
+func (bt *BTree) evict(target int64) {
+	var candidates []evictCandidate
+	total := bt.measure(bt.root, &candidates)
+	defer func() {
+		atomic.StoreInt64(&bt.loaded, total)
+		atomic.StoreInt64(&bt.kept, total)
+	}()
+	if total <= target {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].used < candidates[j].used
+	})
+	for _, c := range candidates {
+		if total <= target {
+			break
+		}
+		// skip the subtrees unloaded along with an ancestor
+		i := c.parent.childIndex(c.node)
+		if i < 0 || !bt.attached(c.parent) {
+			continue
+		}
+		total -= bt.unload(c.parent, i)
+	}
+}
+
+// measure returns the memory used by the loaded nodes of the subtree of n,
+// and collects its clean subtrees as candidates for eviction. The nodes
+// loaded by the reads of the concurrent mode, which are parked in their
+// placeholders, are measured too, each placeholder holding one is a
+// candidate.
+func (bt *BTree) measure(n Node, candidates *[]evictCandidate) int64 {
+	if hn, ok := n.(*HashNode); ok {
+		if parked := hn.loaded(); parked != nil {
+			return bt.measure(parked, nil)
+		}
+		return 0
+	}
+	size := nodeSize(n)
+	in, ok := n.(*InteriorNode)
+	if !ok {
+		return size
+	}
+	for i := 0; i < in.Count; i++ {
+		child := in.Kcs.data[i].Child
+		used := usedOf(child)
+		if hn, ok := child.(*HashNode); ok {
+			parked := hn.loaded()
+			if parked == nil {
+				continue
+			}
+			used = usedOf(parked)
+		}
+		if !child.isDirty() && candidates != nil {
+			*candidates = append(*candidates, evictCandidate{child, in, used})
+		}
+		size += bt.measure(child, candidates)
+	}
+	return size
+}
+
+// attached reports whether n is still part of the tree.
+func (bt *BTree) attached(n *InteriorNode) bool {
+	for n != bt.root {
+		p := n.parent()
+		if p == nil || p.childIndex(n) < 0 {
+			return false
+		}
+		n = p
+	}
+	return true
+}
+
+// unload replaces the clean child at index i of p, and its whole subtree, by
+// a placeholder holding its hash. It returns the memory freed.
+func (bt *BTree) unload(p *InteriorNode, i int) int64 {
+	n := p.Kcs.data[i].Child
+	size := bt.measure(n, nil)
+	if hn, ok := n.(*HashNode); ok {
+		// the parked node is dropped along with its placeholder
+		p.Kcs.data[i].Child = newHashNode(p, hn.Hash, bt.keyLen)
+		return size
+	}
+
+	// the leaves of the subtree must not be reachable through the chain
+	if prev := loadedLeaf(n, -1); prev != nil {
+		prev.next = nil
+	}
+	if next := loadedLeaf(n, 1); next != nil {
+		next.prev = nil
+	}
+	if bt.first != nil && isAncestor(n, bt.first) {
+		bt.first = nil
+	}
+	leaves, interiors := countLoaded(n)
+	bt.addNodes(-leaves, -interiors)
+
+	_, hash, _ := n.cache()
+	p.Kcs.data[i].Child = newHashNode(p, hash, bt.keyLen)
+	n.setParent(nil)
+	return size
+}
+
+func isAncestor(a Node, n Node) bool {
+	for p := n.parent(); p != nil; p = p.parent() {
+		if Node(p) == a {
+			return true
+		}
+	}
+	return false
+}
+
+// countLoaded returns the number of loaded leaf and interior nodes in the
+// subtree of n.
+func countLoaded(n Node) (int, int) {
+	switch node := n.(type) {
+	case *LeafNode:
+		return 1, 0
+	case *InteriorNode:
+		leaves, interiors := 0, 1
+		for i := 0; i < node.Count; i++ {
+			l, in := countLoaded(node.Kcs.data[i].Child)
+			leaves += l
+			interiors += in
+		}
+		return leaves, interiors
+	default:
+		return 0, 0
+	}
+}
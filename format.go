@@ -0,0 +1,282 @@
+package bplustree
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// A node is stored as a header describing its format, followed by the
+// encoding of the node:
+//
+//	magic (1) | version (1) | hasher (1) | capacity (2) | encoding (1) |
+//	compression (1) | flags (1) | node
+//
+// The capacity is the largest number of KVs of a leaf, or KCs of an interior
+// node, of the tree which wrote the node, the encoding is the Encoding of
+// the node, the compression its Compression, and the flags are a set of the
+// flag bits below. The header of version 3 has no flags byte, its flags are
+// all unset, the header of version 2 has no compression byte either, its
+// nodes are uncompressed, and the header of version 1 has no encoding byte
+// either, its nodes are in FixedEncoding. The nodes stored before the header
+// was introduced, version 0, are the bare FixedEncoding of the node, which
+// starts with prefixLeaf or prefixInterior, never with the magic byte, and are
+// hashed with SHA3. The KCs of the interior nodes of version 0 have no Size
+// and no Agg either.
+const (
+	formatMagic   = byte(0xb7)
+	formatVersion = byte(4) // version of the nodes written by the trees
+	headerSize    = 8
+
+	compressionOffset = 6 // offset of the compression byte in the header
+	flagsOffset       = 7 // offset of the flags byte in the header
+)
+
+// headerSizes are the sizes of the headers of each version.
+var headerSizes = [formatVersion + 1]int{0, 5, 6, 7, headerSize}
+
+// The flags of the header.
+const (
+	flagBlobs  = 1 << 0 // the leaf holds tagged Values, see blobLeaf
+	flagsKnown = flagBlobs
+)
+
+// Hasher identifies the hash function which computes the hashes of the nodes,
+// under which they are stored in the db.
+type Hasher byte
+
+const (
+	// SHA3 hashes the nodes with SHA3-256, it is the default hasher and the
+	// one of the nodes stored before the node header.
+	SHA3 Hasher = iota + 1
+
+	// SHA256 hashes the nodes with SHA-256.
+	SHA256
+)
+
+func (h Hasher) known() bool { return h == SHA3 || h == SHA256 }
+
+// sum returns the hash of data.
+func (h Hasher) sum(data []byte) []byte {
+	if h == SHA256 {
+		hash := sha256.Sum256(data)
+		return hash[:]
+	}
+	hash := sha3.Sum256(data)
+	return hash[:]
+}
+
+// WithHasher makes the tree hash its nodes with h, which must be SHA3 or
+// SHA256. A tree loaded without WithHasher uses the hasher of its root node.
+// The tree fails to load the nodes hashed with another hasher.
+func WithHasher(h Hasher) Option {
+	return func(bt *BTree) {
+		bt.hasher = h
+	}
+}
+
+// nodeHeader is the decoded header of a stored node.
+type nodeHeader struct {
+	version     byte
+	hasher      Hasher
+	capacity    int
+	encoding    Encoding
+	compression Compression
+	flags       byte
+}
+
+// readHeader splits a stored node into its header and its encoding, which is
+// compressed if the header says so.
+func readHeader(data []byte) (nodeHeader, []byte, error) {
+	if len(data) == 0 {
+		return nodeHeader{}, nil, ErrCorruptNode
+	}
+	if data[0] != formatMagic {
+		h := nodeHeader{version: 0, hasher: SHA3, capacity: MaxKV}
+		if data[0] == prefixInterior {
+			h.capacity = MaxKC
+		}
+		return h, data, nil
+	}
+	if len(data) < 2 {
+		return nodeHeader{}, nil, ErrCorruptNode
+	}
+	if data[1] == 0 || data[1] > formatVersion {
+		return nodeHeader{}, nil, ErrUnsupportedFormat
+	}
+	size := headerSizes[data[1]]
+	if len(data) < size {
+		return nodeHeader{}, nil, ErrCorruptNode
+	}
+	h := nodeHeader{
+		version:  data[1],
+		hasher:   Hasher(data[2]),
+		capacity: int(binary.BigEndian.Uint16(data[3:])),
+	}
+	if h.version >= 2 {
+		h.encoding = Encoding(data[5])
+	}
+	if h.version >= 3 {
+		h.compression = Compression(data[compressionOffset])
+	}
+	if h.version >= 4 {
+		h.flags = data[flagsOffset]
+	}
+	if !h.hasher.known() || int(h.encoding) >= len(nodeCodecs) || !h.compression.known() ||
+		h.flags&^flagsKnown != 0 {
+		return nodeHeader{}, nil, ErrUnsupportedFormat
+	}
+	return h, data[size:], nil
+}
+
+// encodeNode encodes n in the current format, with the hasher and the
+// encoding of the tree, uncompressed. It also returns the Values of a leaf to
+// be stored as blobs.
+func (bt *BTree) encodeNode(n Node) ([]byte, [][]byte) {
+	data := []byte{formatMagic, formatVersion, byte(bt.hasher), 0, 0, byte(bt.encoding), byte(NoCompression), 0}
+	codec := nodeCodecs[bt.encoding]
+	switch node := n.(type) {
+	case *LeafNode:
+		binary.BigEndian.PutUint16(data[3:], MaxKV)
+		leaf, blobs := bt.blobLeaf(node)
+		if leaf != node {
+			data[flagsOffset] |= flagBlobs
+		}
+		return append(data, codec.encodeLeaf(leaf)...), blobs
+	case *InteriorNode:
+		binary.BigEndian.PutUint16(data[3:], MaxKC)
+		return append(data, codec.encodeInterior(node)...), nil
+	}
+	return append(data, n.encode()...), nil
+}
+
+// headerOf returns the header of a stored node, or the zero header if it
+// can't be read.
+func headerOf(data []byte) nodeHeader {
+	h, _, _ := readHeader(data)
+	return h
+}
+
+// Migrate rewrites the tree committed with root hash in db to the current
+// node format, and returns the root hash of the rewritten tree. The nodes are
+// hashed with the hasher given by WithHasher, SHA3 by default, and encoded
+// with the Encoding given by WithEncoding, and compressed as set by
+// WithCompression, so Migrate also moves a tree from a hasher, an encoding or
+// a compression to another. The Sizes and Aggs missing from the nodes stored
+// before them are computed, with the Aggregator given by WithAggregator.
+// Every node of the tree is read, and repaired from the replica given by
+// WithReplica if it is missing or corrupt, and the nodes of the old tree are
+// left in db.
+func Migrate(db Database, root []byte, keyLen int, cmpFunc func(key1, key2 []byte) int, opts ...Option) ([]byte, error) {
+	bt := &BTree{
+		db:      db,
+		keyLen:  keyLen,
+		cmpFunc: cmpFunc,
+	}
+	for _, opt := range opts {
+		opt(bt)
+	}
+	if bt.hasher == 0 {
+		bt.hasher = SHA3
+	}
+	if !bt.compression.known() {
+		return nil, ErrUnsupportedFormat
+	}
+
+	batch := db.NewBatch()
+	hash, _, _, err := bt.migrate(root, nil, batch)
+	if err != nil {
+		return nil, err
+	}
+	if err := batch.Write(); err != nil {
+		return nil, err
+	}
+	return hash, nil
+}
+
+// migrateBatchSize is the size of the data written by Migrate at once.
+const migrateBatchSize = 1 << 20
+
+// migrate rewrites the subtree of the node stored under hash, at path,
+// through batch, and returns the new hash of the node along with the number
+// of Keys and the aggregate of its subtree.
+func (bt *BTree) migrate(hash []byte, path [][]byte, batch Batch) ([]byte, int, []byte, error) {
+	// the tree is read whatever its hasher, Migrate moves it to another one
+	data, h, payload, err := bt.readNode(hash, 0)
+	if err != nil {
+		return nil, 0, nil, nodeError(hash, path, err)
+	}
+	n, err := decodePayload(h, payload, bt.keyLen, bt.cmpFunc)
+	if err != nil {
+		return nil, 0, nil, nodeError(hash, path, err)
+	}
+
+	var (
+		size int
+		agg  []byte
+	)
+	switch node := n.(type) {
+	case *InteriorNode:
+		path = append(path[:len(path):len(path)], CopyBytes(hash))
+		for i := 0; i < node.Count; i++ {
+			kc := &node.Kcs.data[i]
+			child := kc.Child.(*HashNode)
+			childHash, childSize, childAgg, err := bt.migrate(child.Hash, path, batch)
+			if err != nil {
+				return nil, 0, nil, err
+			}
+			child.Hash = childHash
+			if kc.Size == sizeUnknown {
+				kc.Size, kc.Agg = childSize, childAgg
+			}
+			size += kc.Size
+			if bt.aggregator != nil {
+				agg = bt.aggregator.Merge(agg, kc.Agg)
+			}
+		}
+	case *LeafNode:
+		if err := bt.migrateBlobs(node, h.hasher); err != nil {
+			return nil, 0, nil, err
+		}
+		size, agg = node.Count, bt.aggregateLeaf(node)
+	}
+
+	data, blobs := bt.encodeNode(n)
+	for _, blob := range blobs {
+		if err := batch.Put(bt.hasher.sum(blob), blob); err != nil {
+			return nil, 0, nil, err
+		}
+	}
+	hash = bt.hasher.sum(data)
+	if err := batch.Put(hash, bt.compressNode(data)); err != nil {
+		return nil, 0, nil, err
+	}
+	if batch.ValueSize() >= migrateBatchSize {
+		if err := batch.Write(); err != nil {
+			return nil, 0, nil, err
+		}
+		batch.Reset()
+	}
+	return hash, size, agg, nil
+}
+
+// migrateBlobs reads back inline the Values of the leaf stored out of line
+// which don't stay as they are: the ones which are not larger than the
+// threshold of the tree, and all of them if the leaf, whose hasher is given,
+// is rehashed with another hasher.
+func (bt *BTree) migrateBlobs(l *LeafNode, hasher Hasher) error {
+	src := &BTree{db: bt.db, hasher: hasher, replica: bt.replica}
+	for i := 0; i < l.Count; i++ {
+		kv := &l.Kvs.data[i]
+		if kv.blob == nil || (hasher == bt.hasher && bt.blobThreshold > 0 && kv.blob.size > bt.blobThreshold) {
+			continue
+		}
+		value, err := src.loadBlob(kv.blob)
+		if err != nil {
+			return err
+		}
+		kv.Value, kv.blob = value, nil
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package bplustree
+
+// frozenTree is a detached copy of the dirty nodes of a tree, sealed by
+// Commit so that they can be hashed and written while the tree keeps being
+// updated. The clean children of the frozen nodes are replaced by their
+// hashes.
+type frozenTree struct {
+	root      Node
+	origins   map[Node]frozenOrigin
+	walOffset int64
+}
+
+// frozenOrigin is the live node a frozen node was copied from, and the
+// version of the live node at that time.
+type frozenOrigin struct {
+	node    Node
+	version uint64
+}
+
+func versionOf(n Node) uint64 {
+	switch node := n.(type) {
+	case *LeafNode:
+		return node.version
+	case *InteriorNode:
+		return node.version
+	default:
+		return 0
+	}
+}
+
+// freeze copies the dirty nodes of the tree, the tree must be locked.
+func (bt *BTree) freeze() (*frozenTree, error) {
+	if !bt.compression.known() {
+		return nil, ErrUnsupportedFormat
+	}
+	f := &frozenTree{origins: make(map[Node]frozenOrigin)}
+	if bt.wal != nil {
+		offset, err := bt.wal.size()
+		if err != nil {
+			return nil, err
+		}
+		f.walOffset = offset
+	}
+	// the Sizes and Aggs are committed along with the nodes
+	if _, _, err := bt.summarize(bt.root); err != nil {
+		return nil, err
+	}
+	f.root = f.freezeNode(bt.root)
+	return f, nil
+}
+
+func (f *frozenTree) freezeNode(n Node) Node {
+	dirty, hash, _ := n.cache()
+	if !dirty {
+		return newHashNode(nil, hash, 0)
+	}
+
+	switch node := n.(type) {
+	case *LeafNode:
+		c := newLeafNode(nil, node.keyLen, node.Kvs.cmpFunc)
+		copy(c.Kvs.data, node.Kvs.data[:node.Count])
+		c.Count = node.Count
+		f.origins[c] = frozenOrigin{node, node.version}
+		return c
+	case *InteriorNode:
+		c := newInteriorNode(nil, nil, node.keyLen, node.Kcs.cmpFunc)
+		c.Count = node.Count
+		for i := 0; i < node.Count; i++ {
+			c.Kcs.data[i].Key = node.Kcs.data[i].Key
+			c.Kcs.data[i].Child = f.freezeNode(node.Kcs.data[i].Child)
+			c.Kcs.data[i].Size = node.Kcs.data[i].Size
+			c.Kcs.data[i].Agg = node.Kcs.data[i].Agg
+		}
+		f.origins[c] = frozenOrigin{node, node.version}
+		return c
+	default:
+		return n
+	}
+}
+
+// writeFrozen hashes the frozen nodes and writes them through batch.
+func (bt *BTree) writeFrozen(f *frozenTree, batch Batch) error {
+	if batch == nil {
+		batch = bt.db.NewBatch()
+	}
+
+	bt.dirties = make([]*dirtyNode, 0)
+	hashNode(f.root, bt)
+
+	for _, dirty := range bt.dirties {
+		if err := batch.Put(dirty.hash, dirty.data); err != nil {
+			return err
+		}
+	}
+	return batch.Write()
+}
+
+// publish caches the hashes of the written nodes in the live nodes they were
+// frozen from, along with the references to the blobs written for the leaves,
+// and marks them clean, unless they have been modified since. It returns the
+// hash of the frozen root. The tree must be locked.
+func (bt *BTree) publish(f *frozenTree) []byte {
+	for _, dirty := range bt.dirties {
+		o, ok := f.origins[dirty.origin]
+		if !ok || versionOf(o.node) != o.version {
+			continue
+		}
+		o.node.setCache(dirty.hash, dirty.data)
+		o.node.setDirty(false)
+		if c, ok := dirty.origin.(*LeafNode); ok {
+			keepBlobs(o.node.(*LeafNode), c)
+		}
+	}
+	bt.dirties = nil
+
+	_, root, _ := f.root.cache()
+	return root
+}
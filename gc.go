@@ -0,0 +1,50 @@
+package bplustree
+
+// Reachable calls fn with the key of every node of the tree committed with
+// root in db, and with the key of every blob referenced by its leaves, with
+// blob set. A garbage collector of db keeps the keys reachable from the roots
+// it retains and deletes the others. The nodes are checked to hash to their
+// keys, the blobs are not read, and a blob referenced by several leaves is
+// reported once for each of them. Reachable stops at the first error, of db
+// or returned by fn.
+func Reachable(db Database, root []byte, keyLen int, cmpFunc func(key1, key2 []byte) int, fn func(key []byte, blob bool) error) error {
+	bt := &BTree{db: db, keyLen: keyLen, cmpFunc: cmpFunc}
+	return bt.reachable(root, nil, fn)
+}
+
+// reachable walks the subtree of the node stored under hash, at path.
+func (bt *BTree) reachable(hash []byte, path [][]byte, fn func(key []byte, blob bool) error) error {
+	_, h, payload, err := bt.readNode(hash, bt.hasher)
+	if err != nil {
+		return nodeError(hash, path, err)
+	}
+	// the nodes of the tree are hashed with the hasher of its root
+	bt.hasher = h.hasher
+	n, err := decodePayload(h, payload, bt.keyLen, bt.cmpFunc)
+	if err != nil {
+		return nodeError(hash, path, err)
+	}
+	if err := fn(hash, false); err != nil {
+		return err
+	}
+
+	switch node := n.(type) {
+	case *InteriorNode:
+		path = append(path[:len(path):len(path)], CopyBytes(hash))
+		for i := 0; i < node.Count; i++ {
+			child := node.Kcs.data[i].Child.(*HashNode)
+			if err := bt.reachable(child.Hash, path, fn); err != nil {
+				return err
+			}
+		}
+	case *LeafNode:
+		for i := 0; i < node.Count; i++ {
+			if ref := node.Kvs.data[i].blob; ref != nil {
+				if err := fn(ref.hash, true); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -1,6 +1,6 @@
 module github.com/heeeeeng/bplustree
 
-go 1.12
+go 1.18
 
 require (
 	github.com/philhofer/fwd v1.0.0 // indirect
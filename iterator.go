@@ -0,0 +1,146 @@
+package bplustree
+
+import "bytes"
+
+// Iterator walks the KVs of a range of the tree in Key order, or in reverse
+// Key order. The KVs are read one leaf at a time, and each leaf is reached
+// from the root by seeking the Key right after (or before) the last one
+// read, so the tree can be updated between two calls of Next. The KVs of a
+// leaf are returned as they were when the leaf was read.
+type Iterator struct {
+	bt      *BTree
+	start   []byte
+	end     []byte
+	reverse bool
+	below   bool   // the reverse iteration continues below end, excluded
+	before  []byte // the iteration stops at the first Key not smaller than before
+	prefix  []byte // only the Keys starting with prefix are returned
+	kvs     []leafKV
+	pos     int
+	done    bool
+	err     error
+}
+
+// Iterate returns an Iterator over the KVs with start <= Key <= end, a nil
+// end iterates to the last Key of the tree.
+func (bt *BTree) Iterate(start, end []byte) *Iterator {
+	return &Iterator{bt: bt, start: start, end: end, pos: -1}
+}
+
+// IterateReverse returns an Iterator over the KVs with start <= Key <= end
+// in reverse Key order, a nil start iterates down to the first Key of the
+// tree and a nil end iterates from the last Key of the tree.
+func (bt *BTree) IterateReverse(start, end []byte) *Iterator {
+	return &Iterator{bt: bt, start: start, end: end, reverse: true, pos: -1}
+}
+
+// Next moves the Iterator to the next KV, it returns false when there are no
+// KVs left or on error.
+func (it *Iterator) Next() bool {
+	for it.pos+1 >= len(it.kvs) {
+		if it.done || it.err != nil {
+			it.kvs, it.pos = nil, -1
+			return false
+		}
+		it.kvs, it.pos = it.kvs[:0], -1
+		if it.reverse {
+			it.err = it.readLeafReverse()
+		} else {
+			it.err = it.readLeaf()
+		}
+		if it.err == nil {
+			it.err = it.bt.loadValues(it.kvs)
+		}
+	}
+	it.pos++
+	return true
+}
+
+// readLeaf reads the KVs of the leaf holding the lower bound of the
+// Iterator.
+func (it *Iterator) readLeaf() error {
+	bt := it.bt
+	defer bt.evictIfNeeded()
+	bt.rlockTree()
+	defer bt.runlockTree()
+
+	leaf, bound, err := bt.seekLeaf(it.start)
+	if err != nil {
+		return err
+	}
+	defer bt.runlatch(leaf)
+
+	i, _ := leaf.findSmallest(it.start)
+	for ; i < leaf.Count; i++ {
+		kv := leaf.Kvs.data[i]
+		if (it.end != nil && bt.cmpFunc(kv.Key, it.end) > 0) ||
+			(it.before != nil && bt.cmpFunc(kv.Key, it.before) >= 0) {
+			it.done = true
+			return nil
+		}
+		if it.prefix == nil || bytes.HasPrefix(kv.Key, it.prefix) {
+			it.kvs = append(it.kvs, kv)
+		}
+	}
+	if bound == nil || (it.end != nil && bt.cmpFunc(bound, it.end) > 0) ||
+		(it.before != nil && bt.cmpFunc(bound, it.before) >= 0) {
+		it.done = true
+	}
+	it.start = bound
+	return nil
+}
+
+// readLeafReverse reads the KVs of the leaf holding the upper bound of the
+// Iterator, from the last one.
+func (it *Iterator) readLeafReverse() error {
+	bt := it.bt
+	defer bt.evictIfNeeded()
+	bt.rlockTree()
+	defer bt.runlockTree()
+
+	leaf, bound, _, err := bt.descend(func(in *InteriorNode) int {
+		switch {
+		case it.end == nil:
+			return in.Count - 1
+		case it.below:
+			return in.findBefore(it.end)
+		default:
+			i, _ := in.find(it.end)
+			return i
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer bt.runlatch(leaf)
+
+	i := leaf.Count
+	if it.end != nil {
+		var found bool
+		if i, found = leaf.find(it.end); found && !it.below {
+			i++
+		}
+	}
+	for i--; i >= 0; i-- {
+		kv := leaf.Kvs.data[i]
+		if it.start != nil && bt.cmpFunc(kv.Key, it.start) < 0 {
+			it.done = true
+			return nil
+		}
+		it.kvs = append(it.kvs, kv)
+	}
+	if bound == nil || (it.start != nil && bt.cmpFunc(bound, it.start) <= 0) {
+		it.done = true
+	}
+	it.end, it.below = bound, true
+	return nil
+}
+
+// Key returns the Key of the current KV.
+func (it *Iterator) Key() []byte { return it.kvs[it.pos].Key }
+
+// Value returns the Value of the current KV.
+func (it *Iterator) Value() []byte { return it.kvs[it.pos].Value }
+
+// Err returns the error which stopped the Iterator, if any.
+func (it *Iterator) Err() error { return it.err }
@@ -0,0 +1,173 @@
+// Package keyenc encodes values to byte keys whose order under bytes.Compare
+// is the natural order of the values, so that they can be used as the Keys
+// of a tree compared with bytes.Compare.
+//
+// Every Append function appends the encoding of a value to a buffer and the
+// matching Decode function reads it back from the front of a buffer, returning
+// the rest of the buffer. Encodings of values of the same type can be
+// concatenated to build composite keys, which sort like the tuples of their
+// values, as the encoding of a value is never a prefix of the encoding of
+// another value of the same type.
+package keyenc
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// ErrInvalidEncoding is returned when a buffer doesn't start with the
+// encoding of a value of the expected type.
+var ErrInvalidEncoding = errors.New("keyenc: invalid encoding")
+
+// AppendUint64 appends the 8 big endian bytes of v.
+func AppendUint64(b []byte, v uint64) []byte {
+	return append(b, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// DecodeUint64 decodes a uint64 encoded by AppendUint64.
+func DecodeUint64(b []byte) ([]byte, uint64, error) {
+	if len(b) < 8 {
+		return b, 0, ErrInvalidEncoding
+	}
+	v := uint64(b[0])<<56 | uint64(b[1])<<48 | uint64(b[2])<<40 | uint64(b[3])<<32 |
+		uint64(b[4])<<24 | uint64(b[5])<<16 | uint64(b[6])<<8 | uint64(b[7])
+	return b[8:], v, nil
+}
+
+// AppendInt64 appends v as 8 big endian bytes with the sign bit flipped, so
+// that negative values sort before positive ones.
+func AppendInt64(b []byte, v int64) []byte {
+	return AppendUint64(b, uint64(v)^1<<63)
+}
+
+// DecodeInt64 decodes an int64 encoded by AppendInt64.
+func DecodeInt64(b []byte) ([]byte, int64, error) {
+	b, v, err := DecodeUint64(b)
+	return b, int64(v ^ 1<<63), err
+}
+
+// AppendFloat64 appends the IEEE 754 bits of v, with the sign bit flipped for
+// positive values and all the bits flipped for negative values, so that the
+// values sort by magnitude. -0 sorts right before +0, and NaNs sort after
+// +Inf, or before -Inf for NaNs with the sign bit set.
+func AppendFloat64(b []byte, v float64) []byte {
+	bits := math.Float64bits(v)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return AppendUint64(b, bits)
+}
+
+// DecodeFloat64 decodes a float64 encoded by AppendFloat64.
+func DecodeFloat64(b []byte) ([]byte, float64, error) {
+	b, bits, err := DecodeUint64(b)
+	if err != nil {
+		return b, 0, err
+	}
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return b, math.Float64frombits(bits), nil
+}
+
+// AppendBool appends false as 0 and true as 1.
+func AppendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+// DecodeBool decodes a bool encoded by AppendBool.
+func DecodeBool(b []byte) ([]byte, bool, error) {
+	if len(b) < 1 || b[0] > 1 {
+		return b, false, ErrInvalidEncoding
+	}
+	return b[1:], b[0] == 1, nil
+}
+
+const (
+	escape     = 0x00
+	escaped00  = 0xff
+	terminator = 0x01
+)
+
+// AppendBytes appends v with every 0x00 byte escaped as 0x00 0xff, followed by
+// the terminator 0x00 0x01. The terminator sorts before any escaped byte and
+// any other byte, so v sorts before all the values it is a prefix of.
+func AppendBytes(b []byte, v []byte) []byte {
+	for _, c := range v {
+		if c == escape {
+			b = append(b, escape, escaped00)
+		} else {
+			b = append(b, c)
+		}
+	}
+	return append(b, escape, terminator)
+}
+
+// DecodeBytes decodes a byte slice encoded by AppendBytes.
+func DecodeBytes(b []byte) ([]byte, []byte, error) {
+	var v []byte
+	for i := 0; i < len(b); i++ {
+		if b[i] != escape {
+			v = append(v, b[i])
+			continue
+		}
+		if i+1 == len(b) {
+			break
+		}
+		switch b[i+1] {
+		case escaped00:
+			v = append(v, escape)
+			i++
+		case terminator:
+			if v == nil {
+				v = []byte{}
+			}
+			return b[i+2:], v, nil
+		default:
+			return b, nil, ErrInvalidEncoding
+		}
+	}
+	return b, nil, ErrInvalidEncoding
+}
+
+// AppendString appends v like AppendBytes.
+func AppendString(b []byte, v string) []byte {
+	return AppendBytes(b, []byte(v))
+}
+
+// DecodeString decodes a string encoded by AppendString.
+func DecodeString(b []byte) ([]byte, string, error) {
+	b, v, err := DecodeBytes(b)
+	return b, string(v), err
+}
+
+// AppendTime appends the seconds of v since the Unix epoch, encoded by
+// AppendInt64, followed by the nanoseconds within the second as 4 big endian
+// bytes. The location of v is not encoded.
+func AppendTime(b []byte, v time.Time) []byte {
+	b = AppendInt64(b, v.Unix())
+	nsec := uint32(v.Nanosecond())
+	return append(b, byte(nsec>>24), byte(nsec>>16), byte(nsec>>8), byte(nsec))
+}
+
+// DecodeTime decodes a time encoded by AppendTime, in UTC.
+func DecodeTime(b []byte) ([]byte, time.Time, error) {
+	b, sec, err := DecodeInt64(b)
+	if err != nil || len(b) < 4 {
+		return b, time.Time{}, ErrInvalidEncoding
+	}
+	nsec := uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	if nsec >= 1e9 {
+		return b, time.Time{}, ErrInvalidEncoding
+	}
+	return b[4:], time.Unix(sec, int64(nsec)).UTC(), nil
+}
@@ -0,0 +1,172 @@
+package keyenc
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/heeeeeng/bplustree"
+)
+
+// verifyOrder checks that the encodings of values, which are sorted, are
+// sorted too.
+func verifyOrder(name string, encoded [][]byte, t *testing.T) {
+	for i := 1; i < len(encoded); i++ {
+		if bytes.Compare(encoded[i-1], encoded[i]) >= 0 {
+			t.Errorf("%s: encoding %d = %x doesn't sort before %d = %x", name, i-1, encoded[i-1], i, encoded[i])
+		}
+	}
+}
+
+func TestInt64(t *testing.T) {
+	values := []int64{math.MinInt64, -1 << 40, -256, -1, 0, 1, 255, 1 << 40, math.MaxInt64}
+	var encoded [][]byte
+	for _, v := range values {
+		b := AppendInt64(nil, v)
+		encoded = append(encoded, b)
+		if rest, got, err := DecodeInt64(b); err != nil || got != v || len(rest) != 0 {
+			t.Errorf("decode %d: got = %d, %v", v, got, err)
+		}
+	}
+	verifyOrder("int64", encoded, t)
+
+	if _, _, err := DecodeInt64([]byte{1, 2}); err != ErrInvalidEncoding {
+		t.Errorf("decode short: want = %v, got = %v", ErrInvalidEncoding, err)
+	}
+}
+
+func TestFloat64(t *testing.T) {
+	values := []float64{math.Inf(-1), -math.MaxFloat64, -1.5, -math.SmallestNonzeroFloat64,
+		math.Copysign(0, -1), 0, math.SmallestNonzeroFloat64, 1, 1.5, math.MaxFloat64, math.Inf(1)}
+	var encoded [][]byte
+	for _, v := range values {
+		b := AppendFloat64(nil, v)
+		encoded = append(encoded, b)
+		if _, got, err := DecodeFloat64(b); err != nil || math.Float64bits(got) != math.Float64bits(v) {
+			t.Errorf("decode %v: got = %v, %v", v, got, err)
+		}
+	}
+	verifyOrder("float64", encoded, t)
+}
+
+func TestString(t *testing.T) {
+	values := []string{"", "\x00", "\x00\x00", "\x00\x01", "\x01", "a", "a\x00", "a\x00b", "a\x01", "ab", "b", "\xff"}
+	var encoded [][]byte
+	for _, v := range values {
+		b := AppendString(nil, v)
+		encoded = append(encoded, b)
+		if rest, got, err := DecodeString(append(b, 'x')); err != nil || got != v || string(rest) != "x" {
+			t.Errorf("decode %q: got = %q, %q, %v", v, got, rest, err)
+		}
+	}
+	verifyOrder("string", encoded, t)
+
+	for _, b := range [][]byte{{'a'}, {'a', 0}, {'a', 0, 2}} {
+		if _, _, err := DecodeString(b); err != ErrInvalidEncoding {
+			t.Errorf("decode %x: want = %v, got = %v", b, ErrInvalidEncoding, err)
+		}
+	}
+}
+
+func TestBoolAndTime(t *testing.T) {
+	verifyOrder("bool", [][]byte{AppendBool(nil, false), AppendBool(nil, true)}, t)
+	if _, v, err := DecodeBool([]byte{1}); err != nil || !v {
+		t.Errorf("decode true: got = %v, %v", v, err)
+	}
+	if _, _, err := DecodeBool([]byte{2}); err != ErrInvalidEncoding {
+		t.Errorf("decode 2: want = %v, got = %v", ErrInvalidEncoding, err)
+	}
+
+	base := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	times := []time.Time{time.Unix(-1, 999999999), time.Unix(0, 0), base, base.Add(1), base.Add(time.Second)}
+	var encoded [][]byte
+	for _, v := range times {
+		b := AppendTime(nil, v)
+		encoded = append(encoded, b)
+		if _, got, err := DecodeTime(b); err != nil || !got.Equal(v) {
+			t.Errorf("decode %v: got = %v, %v", v, got, err)
+		}
+	}
+	verifyOrder("time", encoded, t)
+}
+
+func TestTuple(t *testing.T) {
+	now := time.Unix(1600000000, 0).UTC()
+	tuples := []Tuple{
+		{nil},
+		{false, "b"},
+		{true},
+		{int64(-5), "z"},
+		{int64(-5), "z", int64(1)},
+		{int64(3)},
+		{int64(3), "a"},
+		{int64(3), "a\x00"},
+		{int64(3), "b"},
+		{uint64(1)},
+		{1.5},
+		{now},
+		{[]byte{0, 1}},
+		{"a", int64(-1)},
+		{"a", int64(0)},
+		{"ab"},
+	}
+	var encoded [][]byte
+	for _, tuple := range tuples {
+		b, err := tuple.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, b)
+		if got, err := DecodeTuple(b); err != nil || !reflect.DeepEqual(got, tuple) {
+			t.Errorf("decode %v: got = %v, %v", tuple, got, err)
+		}
+	}
+	verifyOrder("tuple", encoded, t)
+
+	if _, err := (Tuple{struct{}{}}).Encode(); err == nil {
+		t.Errorf("encode unsupported type: want error, got = nil")
+	}
+	if _, err := DecodeTuple([]byte{0xee}); err != ErrInvalidEncoding {
+		t.Errorf("decode unknown tag: want = %v, got = %v", ErrInvalidEncoding, err)
+	}
+	if got, _ := DecodeTuple(AppendInt64([]byte{tagInt}, 7)); !reflect.DeepEqual(got, Tuple{int64(7)}) {
+		t.Errorf("decode int: got = %v", got)
+	}
+}
+
+func TestTreeOrder(t *testing.T) {
+	bt := bplustree.NewBTree(bplustree.NewMemDatabase(), 32, bytes.Compare)
+	var keys []string
+	for i := -50; i < 50; i++ {
+		for _, name := range []string{"x", "", "y\x00"} {
+			key, _ := Tuple{name, int64(i * 7)}.Encode()
+			if err := bt.Insert(key, nil); err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, string(key))
+		}
+	}
+	sort.Strings(keys)
+
+	i := 0
+	var prev Tuple
+	for it := bt.Iterate(nil, nil); it.Next(); i++ {
+		tuple, err := DecodeTuple(it.Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(it.Key()) != keys[i] {
+			t.Fatalf("key %d: got = %v after %v", i, tuple, prev)
+		}
+		if prev != nil && prev[0] == tuple[0] && prev[1].(int64) >= tuple[1].(int64) {
+			t.Errorf("key %d: %v sorts after %v", i, tuple, prev)
+		}
+		prev = tuple
+	}
+	if i != len(keys) {
+		t.Errorf("iterate: want = %d, got = %d", len(keys), i)
+	}
+}
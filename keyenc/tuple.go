@@ -0,0 +1,110 @@
+package keyenc
+
+import (
+	"fmt"
+	"time"
+)
+
+// Type tags of the elements of a tuple, tuples with elements of different
+// types at the same position sort by the tags.
+const (
+	tagNil byte = iota + 1
+	tagFalse
+	tagTrue
+	tagInt
+	tagUint
+	tagFloat
+	tagTime
+	tagBytes
+	tagString
+)
+
+// Tuple is a composite key. Its elements can be nil, bool, int, int64,
+// uint64, float64, time.Time, []byte and string, and are encoded with a type
+// tag so that tuples can be decoded without knowing their types. Tuples sort
+// element by element, and a tuple sorts before the tuples it is a prefix of.
+type Tuple []interface{}
+
+// AppendTuple appends the encoding of t, it returns an error if t holds an
+// element of an unsupported type.
+func AppendTuple(b []byte, t Tuple) ([]byte, error) {
+	for i, e := range t {
+		switch v := e.(type) {
+		case nil:
+			b = append(b, tagNil)
+		case bool:
+			if v {
+				b = append(b, tagTrue)
+			} else {
+				b = append(b, tagFalse)
+			}
+		case int:
+			b = AppendInt64(append(b, tagInt), int64(v))
+		case int64:
+			b = AppendInt64(append(b, tagInt), v)
+		case uint64:
+			b = AppendUint64(append(b, tagUint), v)
+		case float64:
+			b = AppendFloat64(append(b, tagFloat), v)
+		case time.Time:
+			b = AppendTime(append(b, tagTime), v)
+		case []byte:
+			b = AppendBytes(append(b, tagBytes), v)
+		case string:
+			b = AppendString(append(b, tagString), v)
+		default:
+			return nil, fmt.Errorf("keyenc: unsupported type %T of tuple element %d", e, i)
+		}
+	}
+	return b, nil
+}
+
+// Encode returns the encoding of t.
+func (t Tuple) Encode() ([]byte, error) {
+	return AppendTuple(nil, t)
+}
+
+// DecodeTuple decodes all of b as a tuple encoded by AppendTuple, the int
+// elements are decoded as int64.
+func DecodeTuple(b []byte) (Tuple, error) {
+	var t Tuple
+	for len(b) > 0 {
+		var (
+			e   interface{}
+			err error
+		)
+		tag := b[0]
+		b = b[1:]
+		switch tag {
+		case tagNil:
+		case tagFalse:
+			e = false
+		case tagTrue:
+			e = true
+		case tagInt:
+			b, e, err = decodeAs(DecodeInt64, b)
+		case tagUint:
+			b, e, err = decodeAs(DecodeUint64, b)
+		case tagFloat:
+			b, e, err = decodeAs(DecodeFloat64, b)
+		case tagTime:
+			b, e, err = decodeAs(DecodeTime, b)
+		case tagBytes:
+			b, e, err = decodeAs(DecodeBytes, b)
+		case tagString:
+			b, e, err = decodeAs(DecodeString, b)
+		default:
+			err = ErrInvalidEncoding
+		}
+		if err != nil {
+			return nil, err
+		}
+		t = append(t, e)
+	}
+	return t, nil
+}
+
+func decodeAs[T any](decode func([]byte) ([]byte, T, error), b []byte) ([]byte, interface{}, error) {
+	b, v, err := decode(b)
+	return b, v, err
+}
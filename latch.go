@@ -0,0 +1,240 @@
+package bplustree
+
+import "sync"
+
+// In concurrent mode every operation holds treeLock, shared by Insert,
+// Delete, Search and SearchRange, which synchronize with each other through
+// node latches, and exclusive for all the others. rootLatch guards bt.root
+// and bt.height, it is always taken before the latch of the root node.
+
+func (bt *BTree) rlockTree() {
+	if bt.concurrent {
+		bt.treeLock.RLock()
+	}
+}
+
+func (bt *BTree) runlockTree() {
+	if bt.concurrent {
+		bt.treeLock.RUnlock()
+	}
+}
+
+// lockTree locks the whole tree and brings the dirty flags of all the nodes
+// up to date.
+func (bt *BTree) lockTree() {
+	if bt.concurrent {
+		bt.treeLock.Lock()
+		bt.flushDirty()
+	}
+}
+
+func (bt *BTree) unlockTree() {
+	if bt.concurrent {
+		bt.treeLock.Unlock()
+	}
+}
+
+func latchOf(n Node) *sync.RWMutex {
+	switch node := n.(type) {
+	case *LeafNode:
+		return &node.latch
+	case *InteriorNode:
+		return &node.latch
+	default:
+		return nil
+	}
+}
+
+func (bt *BTree) latch(n Node) {
+	if l := latchOf(n); bt.concurrent && l != nil {
+		l.Lock()
+	}
+}
+
+func (bt *BTree) unlatch(n Node) {
+	if l := latchOf(n); bt.concurrent && l != nil {
+		l.Unlock()
+	}
+}
+
+func (bt *BTree) rlatch(n Node) {
+	if l := latchOf(n); bt.concurrent && l != nil {
+		l.RLock()
+	}
+}
+
+func (bt *BTree) runlatch(n Node) {
+	if l := latchOf(n); bt.concurrent && l != nil {
+		l.RUnlock()
+	}
+}
+
+// latches holds the latches taken by a writer on its way down the tree.
+type latches struct {
+	nodes []Node
+	root  bool
+}
+
+// insertSafe reports whether inserting a Key under n can't split n.
+func insertSafe(n Node, root bool) bool {
+	return !n.full()
+}
+
+// deleteSafe reports whether deleting a Key under n can't make n underflow,
+// or shrink the tree when n is the root.
+func deleteSafe(n Node, root bool) bool {
+	if root {
+		return n.count() > 2
+	}
+	switch n.(type) {
+	case *LeafNode:
+		return n.count() > MaxKV/2
+	default:
+		return n.count() > MaxKC/2
+	}
+}
+
+// lockPath returns the leaf for key. In concurrent mode the path to the leaf
+// is latched top down, releasing all the latches above a node which is safe
+// for the operation, so that the returned latches cover every node that the
+// operation may modify. On error the latches taken so far are returned too,
+// to be released by the caller.
+func (bt *BTree) lockPath(key []byte, safe func(n Node, root bool) bool) (*LeafNode, *latches, error) {
+	if !bt.concurrent {
+		_, _, _, leaf, err := bt.search(key, true)
+		return leaf, nil, err
+	}
+
+	held := &latches{root: true}
+	bt.rootLatch.Lock()
+
+	var n Node = bt.root
+	for root := true; ; root = false {
+		bt.latch(n)
+		if safe(n, root) {
+			bt.unlockPath(held)
+			held.nodes, held.root = held.nodes[:0], false
+		}
+		held.nodes = append(held.nodes, n)
+		bt.use(n)
+
+		switch t := n.(type) {
+		case *LeafNode:
+			return t, held, nil
+		case *InteriorNode:
+			i, _ := t.find(key)
+			child, err := bt.child(t, i)
+			if err != nil {
+				return nil, held, err
+			}
+			n = child
+		default:
+			return nil, held, ErrCorruptNode
+		}
+	}
+}
+
+func (bt *BTree) unlockPath(held *latches) {
+	if held == nil {
+		return
+	}
+	for _, n := range held.nodes {
+		bt.unlatch(n)
+	}
+	if held.root {
+		bt.rootLatch.Unlock()
+	}
+}
+
+// seekLeaf returns the leaf for key, read latched in concurrent mode, and the
+// lower bound of the Keys of the next leaf, or nil if the leaf is the last one.
+// No latch is held on error.
+func (bt *BTree) seekLeaf(key []byte) (*LeafNode, []byte, error) {
+	leaf, _, hi, err := bt.descend(func(in *InteriorNode) int {
+		i, _ := in.find(key)
+		return i
+	})
+	return leaf, hi, err
+}
+
+// descend returns the leaf reached from the root by taking the child at the
+// index returned by pick in every interior node, read latched in concurrent
+// mode, and the bounds [lo, hi) of the Keys of the leaf, nil when unbounded.
+// No latch is held on error.
+func (bt *BTree) descend(pick func(in *InteriorNode) int) (*LeafNode, []byte, []byte, error) {
+	var lo, hi []byte
+
+	if bt.concurrent {
+		bt.rootLatch.RLock()
+	}
+	var n Node = bt.root
+	bt.rlatch(n)
+	if bt.concurrent {
+		bt.rootLatch.RUnlock()
+	}
+
+	for {
+		bt.use(n)
+		in, ok := n.(*InteriorNode)
+		if !ok {
+			leaf, ok := n.(*LeafNode)
+			if !ok {
+				bt.runlatch(n)
+				return nil, nil, nil, ErrCorruptNode
+			}
+			return leaf, lo, hi, nil
+		}
+		i := pick(in)
+		if i > 0 {
+			lo = in.Kcs.data[i-1].Key
+		}
+		if i < in.Count-1 {
+			hi = in.Kcs.data[i].Key
+		}
+		child, err := bt.resolveChild(in, i, false)
+		if err != nil {
+			bt.runlatch(in)
+			return nil, nil, nil, err
+		}
+		bt.rlatch(child)
+		bt.runlatch(in)
+		n = child
+	}
+}
+
+func (bt *BTree) addNodes(leaf, interior int) {
+	if bt.concurrent {
+		bt.countLock.Lock()
+		defer bt.countLock.Unlock()
+	}
+	bt.leaf += leaf
+	bt.interior += interior
+}
+
+// dirtyPath marks the ancestors of the leaf dirty after the leaf has been
+// modified. In concurrent mode the ancestors may be latched by other writers,
+// so the leaf is queued, unless it is queued already, and its ancestors are
+// marked by flushDirty once the tree is locked. While a commit is in progress
+// the leaf is always queued, as its ancestors must get a new version even if
+// they are still dirty from before the commit.
+func (bt *BTree) dirtyPath(leaf *LeafNode) {
+	if !bt.concurrent {
+		markPathDirty(leaf)
+		return
+	}
+	if leaf.queued && !bt.committing {
+		return
+	}
+	leaf.queued = true
+	bt.pendingLock.Lock()
+	bt.pending = append(bt.pending, leaf)
+	bt.pendingLock.Unlock()
+}
+
+func (bt *BTree) flushDirty() {
+	for _, leaf := range bt.pending {
+		leaf.queued = false
+		markPathDirty(leaf)
+	}
+	bt.pending = nil
+}
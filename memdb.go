@@ -88,13 +88,16 @@ func (db *MemDatabase) Delete(key []byte) error {
 
 func (db *MemDatabase) Close() {}
 
-//func (db *MemDatabase) NewBatch() Batch {
-//	return &memBatch{db: db}
-//}
+func (db *MemDatabase) NewBatch() Batch {
+	return &memBatch{db: db}
+}
 
 func (db *MemDatabase) Len() int { return len(db.db) }
 
-type keyValue struct{ k, v []byte }
+type keyValue struct {
+	k, v []byte
+	del  bool
+}
 
 type memBatch struct {
 	db     *MemDatabase
@@ -103,16 +106,28 @@ type memBatch struct {
 }
 
 func (b *memBatch) Put(key, value []byte) error {
-	b.writes = append(b.writes, keyValue{CopyBytes(key), CopyBytes(value)})
+	b.writes = append(b.writes, keyValue{CopyBytes(key), CopyBytes(value), false})
 	b.size += len(value)
 	return nil
 }
 
+func (b *memBatch) Delete(key []byte) error {
+	b.writes = append(b.writes, keyValue{CopyBytes(key), nil, true})
+	b.size++
+	return nil
+}
+
+// Write applies all the batched writes to the host database at once, no
+// reader of the database can observe a partially written batch.
 func (b *memBatch) Write() error {
 	b.db.lock.Lock()
 	defer b.db.lock.Unlock()
 
 	for _, kv := range b.writes {
+		if kv.del {
+			delete(b.db.db, string(kv.k))
+			continue
+		}
 		b.db.db[string(kv.k)] = kv.v
 	}
 	return nil
@@ -127,6 +142,22 @@ func (b *memBatch) Reset() {
 	b.size = 0
 }
 
+// Replay replays the batch contents in order into w.
+func (b *memBatch) Replay(w Writer) error {
+	for _, kv := range b.writes {
+		if kv.del {
+			if err := w.Delete(kv.k); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.Put(kv.k, kv.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // CopyBytes returns an exact copy of the provided bytes.
 func CopyBytes(b []byte) (copiedBytes []byte) {
 	if b == nil {
@@ -0,0 +1,160 @@
+package bplustree
+
+// Min returns the KV with the smallest Key, false if the tree is empty.
+func (bt *BTree) Min() (KV, bool, error) {
+	defer bt.evictIfNeeded()
+	bt.rlockTree()
+	defer bt.runlockTree()
+
+	return bt.resolveKV(bt.min())
+}
+
+func (bt *BTree) min() (leafKV, bool, error) {
+	leaf, _, hi, err := bt.descend(func(in *InteriorNode) int { return 0 })
+	if err != nil {
+		return leafKV{}, false, err
+	}
+	if leaf.Count > 0 {
+		defer bt.runlatch(leaf)
+		return leaf.Kvs.data[0], true, nil
+	}
+	bt.runlatch(leaf)
+	if hi == nil {
+		return leafKV{}, false, nil
+	}
+	return bt.after(hi, true)
+}
+
+// Max returns the KV with the largest Key, false if the tree is empty.
+func (bt *BTree) Max() (KV, bool, error) {
+	defer bt.evictIfNeeded()
+	bt.rlockTree()
+	defer bt.runlockTree()
+
+	return bt.resolveKV(bt.max())
+}
+
+func (bt *BTree) max() (leafKV, bool, error) {
+	leaf, lo, _, err := bt.descend(func(in *InteriorNode) int { return in.Count - 1 })
+	if err != nil {
+		return leafKV{}, false, err
+	}
+	if leaf.Count > 0 {
+		defer bt.runlatch(leaf)
+		return leaf.Kvs.data[leaf.Count-1], true, nil
+	}
+	bt.runlatch(leaf)
+	if lo == nil {
+		return leafKV{}, false, nil
+	}
+	return bt.before(lo, false)
+}
+
+// Ceiling returns the KV with the smallest Key >= key, false if there is none.
+func (bt *BTree) Ceiling(key []byte) (KV, bool, error) {
+	defer bt.evictIfNeeded()
+	bt.rlockTree()
+	defer bt.runlockTree()
+
+	return bt.resolveKV(bt.after(key, true))
+}
+
+// Higher returns the KV with the smallest Key > key, false if there is none.
+func (bt *BTree) Higher(key []byte) (KV, bool, error) {
+	defer bt.evictIfNeeded()
+	bt.rlockTree()
+	defer bt.runlockTree()
+
+	return bt.resolveKV(bt.after(key, false))
+}
+
+// Floor returns the KV with the largest Key <= key, false if there is none.
+func (bt *BTree) Floor(key []byte) (KV, bool, error) {
+	defer bt.evictIfNeeded()
+	bt.rlockTree()
+	defer bt.runlockTree()
+
+	return bt.resolveKV(bt.before(key, true))
+}
+
+// Lower returns the KV with the largest Key < key, false if there is none.
+func (bt *BTree) Lower(key []byte) (KV, bool, error) {
+	defer bt.evictIfNeeded()
+	bt.rlockTree()
+	defer bt.runlockTree()
+
+	return bt.resolveKV(bt.before(key, false))
+}
+
+// after returns the KV with the smallest Key after key, or equal to key if
+// inclusive is set. When the leaf of key has no such KV, the answer is the
+// first KV of the next leaf, which is reached through the chaining of the
+// leaves if it is loaded, or from the root otherwise.
+func (bt *BTree) after(key []byte, inclusive bool) (leafKV, bool, error) {
+	for {
+		leaf, _, hi, err := bt.descend(func(in *InteriorNode) int {
+			i, _ := in.find(key)
+			return i
+		})
+		if err != nil {
+			return leafKV{}, false, err
+		}
+		i, found := leaf.find(key)
+		if found && !inclusive {
+			i++
+		}
+		if i < leaf.Count {
+			kv := leaf.Kvs.data[i]
+			bt.runlatch(leaf)
+			return kv, true, nil
+		}
+		if next := leaf.next; !bt.concurrent && next != nil && next.Count > 0 {
+			return next.Kvs.data[0], true, nil
+		}
+		bt.runlatch(leaf)
+
+		if hi == nil {
+			return leafKV{}, false, nil
+		}
+		key, inclusive = hi, true
+	}
+}
+
+// before returns the KV with the largest Key before key, or equal to key if
+// inclusive is set. When the leaf of key has no such KV, the answer is the
+// last KV of the previous leaf, which is reached through the chaining of the
+// leaves if it is loaded, or from the root by seeking the largest Key below
+// the lower bound of the leaf.
+func (bt *BTree) before(key []byte, inclusive bool) (leafKV, bool, error) {
+	for {
+		k, incl := key, inclusive
+		leaf, lo, _, err := bt.descend(func(in *InteriorNode) int {
+			if incl {
+				i, _ := in.find(k)
+				return i
+			}
+			return in.findBefore(k)
+		})
+		if err != nil {
+			return leafKV{}, false, err
+		}
+		i, found := leaf.find(key)
+		if found && inclusive {
+			i++
+		}
+		if i > 0 {
+			kv := leaf.Kvs.data[i-1]
+			bt.runlatch(leaf)
+			return kv, true, nil
+		}
+		if prev := leaf.prev; !bt.concurrent && prev != nil && prev.Count > 0 {
+			return prev.Kvs.data[prev.Count-1], true, nil
+		}
+		bt.runlatch(leaf)
+
+		if lo == nil {
+			return leafKV{}, false, nil
+		}
+		key, inclusive = lo, false
+	}
+}
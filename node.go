@@ -14,15 +14,10 @@ type Node interface {
 	isDirty() bool
 	setDirty(bool)
 	cache() (bool, []byte, []byte)
+	setCache(hash, data []byte)
 	largestKey() []byte
 	encode() (value []byte)
-	decode(data []byte)
-
-	//DecodeMsg(dc *msgp.Reader) (err error)
-	//EncodeMsg(en *msgp.Writer) (err error)
-	//MarshalMsg(b []byte) (o []byte, err error)
-	//UnmarshalMsg(bts []byte) (o []byte, err error)
-	//Msgsize() (s int)
+	decode(data []byte) error
 }
 
 var (
@@ -31,3 +26,61 @@ var (
 	suffixLeaf     = byte(0)
 	suffixInterior = byte(1)
 )
+
+// readBytes reads an int32 length prefixed byte slice from data at offset
+// pos, it returns the slice and the offset right after it.
+func readBytes(data []byte, pos int) ([]byte, int, error) {
+	if pos+4 > len(data) {
+		return nil, 0, ErrCorruptNode
+	}
+	size := int(BytesToInt32(data[pos:]))
+	pos += 4
+	if size < 0 || pos+size > len(data) {
+		return nil, 0, ErrCorruptNode
+	}
+	return data[pos : pos+size : pos+size], pos + size, nil
+}
+
+// decodePayload decodes the uncompressed encoding of a stored node of any
+// supported format version, whose header is h, see readNode. The children of
+// an interior node are left as unresolved HashNode.
+func decodePayload(h nodeHeader, data []byte, keyLen int, cmpFunc func(key1, key2 []byte) int) (Node, error) {
+	if len(data) == 0 {
+		return nil, ErrCorruptNode
+	}
+	var (
+		n   Node
+		err error
+	)
+	switch data[0] {
+	case prefixLeaf:
+		if h.capacity > MaxKV {
+			return nil, ErrUnsupportedFormat
+		}
+		n = newLeafNode(nil, keyLen, cmpFunc)
+	case prefixInterior:
+		if h.capacity > MaxKC {
+			return nil, ErrUnsupportedFormat
+		}
+		n = newInteriorNode(nil, nil, keyLen, cmpFunc)
+	default:
+		return nil, ErrCorruptNode
+	}
+	codec := nodeCodecs[h.encoding]
+	switch node := n.(type) {
+	case *LeafNode:
+		if err = codec.decodeLeaf(node, data); err == nil && h.flags&flagBlobs != 0 {
+			err = untagLeaf(node)
+		}
+	case *InteriorNode:
+		if h.version == 0 {
+			err = node.decodeUnsized(data)
+		} else if err = codec.decodeInterior(node, data); err == nil && h.flags&flagBlobs != 0 {
+			err = ErrCorruptNode
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
@@ -0,0 +1,137 @@
+package bplustree
+
+import (
+	"container/list"
+	"sync"
+)
+
+// NodeCache is an LRU cache of decoded nodes keyed by node hash. The cache is
+// bounded by the total encoded size of the cached nodes. Cached nodes are
+// never handed out, each lookup returns a copy, so a NodeCache can be shared
+// by all the trees over the same db. It is safe for concurrent use.
+type NodeCache struct {
+	lock     sync.Mutex
+	capacity int
+	size     int
+	lru      *list.List
+	items    map[string]*list.Element
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// CacheStats holds the metrics of a NodeCache.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Len       int // number of cached nodes
+	Size      int // total encoded size of the cached nodes
+}
+
+type cacheEntry struct {
+	key  string
+	node Node
+	size int
+}
+
+// NewNodeCache creates a NodeCache holding up to capacity bytes of encoded nodes.
+func NewNodeCache(capacity int) *NodeCache {
+	return &NodeCache{
+		capacity: capacity,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// WithNodeCache makes the tree look up the nodes it loads from db in c first.
+func WithNodeCache(c *NodeCache) Option {
+	return func(bt *BTree) {
+		bt.cache = c
+	}
+}
+
+// get returns a copy of the node cached under hash.
+func (c *NodeCache) get(hash []byte) (Node, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.items[string(hash)]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	return cloneNode(elem.Value.(*cacheEntry).node), true
+}
+
+// add caches n under hash, n must not be modified afterwards.
+func (c *NodeCache) add(hash []byte, n Node, size int) {
+	if size > c.capacity {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.items[string(hash)]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+	entry := &cacheEntry{key: string(hash), node: n, size: size}
+	c.items[entry.key] = c.lru.PushFront(entry)
+	c.size += size
+
+	for c.size > c.capacity {
+		oldest := c.lru.Back()
+		evicted := c.lru.Remove(oldest).(*cacheEntry)
+		delete(c.items, evicted.key)
+		c.size -= evicted.size
+		c.evictions++
+	}
+}
+
+// Stats returns the metrics of the cache.
+func (c *NodeCache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Len:       c.lru.Len(),
+		Size:      c.size,
+	}
+}
+
+// cloneNode copies a clean node which has just been decoded, the children of
+// an interior node are unresolved.
+func cloneNode(n Node) Node {
+	switch node := n.(type) {
+	case *LeafNode:
+		c := newLeafNode(nil, node.keyLen, node.Kvs.cmpFunc)
+		copy(c.Kvs.data, node.Kvs.data[:node.Count])
+		c.Count = node.Count
+		c.setCache(node.cacheHash, node.cacheData)
+		c.dirty = false
+		return c
+	case *InteriorNode:
+		c := newInteriorNode(nil, nil, node.keyLen, node.Kcs.cmpFunc)
+		c.Count = node.Count
+		for i := 0; i < node.Count; i++ {
+			kc := node.Kcs.data[i]
+			c.Kcs.data[i].Key = kc.Key
+			c.Kcs.data[i].Child = newHashNode(c, kc.Child.(*HashNode).Hash, node.keyLen)
+			c.Kcs.data[i].Size = kc.Size
+			c.Kcs.data[i].Agg = kc.Agg
+		}
+		c.setCache(node.cacheHash, node.cacheData)
+		c.dirty = false
+		return c
+	default:
+		return n
+	}
+}
@@ -0,0 +1,57 @@
+package bplustree
+
+// Encoding identifies the encoding of the entries of the stored nodes.
+type Encoding byte
+
+const (
+	// FixedEncoding prefixes the Keys, Values, hashes and Aggs with their
+	// length as 4 bytes, it is the default encoding and the one of the nodes
+	// stored before version 2 of the node format.
+	FixedEncoding Encoding = iota
+
+	// CompactEncoding prefixes them with their length as a uvarint, and
+	// stores each Key as the length of the prefix it shares with the previous
+	// Key followed by the rest of the Key, see encodeCompact.
+	CompactEncoding
+
+	// MsgpEncoding encodes the entries as MessagePack, see msgpCodec.
+	MsgpEncoding
+)
+
+// WithEncoding makes the tree encode the nodes it stores with e. A tree loaded
+// without WithEncoding uses the encoding of its root node. The trees read the
+// nodes of every encoding. e must be one of the Encodings above.
+func WithEncoding(e Encoding) Option {
+	return func(bt *BTree) {
+		bt.encoding = e
+		bt.encodingSet = true
+	}
+}
+
+// nodeCodec encodes and decodes the nodes in an Encoding. The encoding of a
+// node starts with its type prefix, prefixLeaf or prefixInterior.
+type nodeCodec interface {
+	encodeLeaf(l *LeafNode) []byte
+	decodeLeaf(l *LeafNode, data []byte) error
+	encodeInterior(in *InteriorNode) []byte
+	decodeInterior(in *InteriorNode, data []byte) error
+}
+
+// nodeCodecs are the codecs of the Encodings.
+var nodeCodecs = [...]nodeCodec{
+	FixedEncoding:   fixedCodec{},
+	CompactEncoding: compactCodec{},
+	MsgpEncoding:    msgpCodec{},
+}
+
+// fixedCodec encodes the nodes in FixedEncoding, with their encode and decode
+// methods.
+type fixedCodec struct{}
+
+func (fixedCodec) encodeLeaf(l *LeafNode) []byte { return l.encode() }
+
+func (fixedCodec) decodeLeaf(l *LeafNode, data []byte) error { return l.decode(data) }
+
+func (fixedCodec) encodeInterior(in *InteriorNode) []byte { return in.encode() }
+
+func (fixedCodec) decodeInterior(in *InteriorNode, data []byte) error { return in.decode(data) }
@@ -1,18 +1,77 @@
 package bplustree
 
-// TODO
+import "sync"
+
+// HashNode is a placeholder for a committed node that has not been loaded
+// from the db yet, only the hash of the node is known. The node is loaded
+// by resolve the first time it is needed.
 type HashNode struct {
 	Hash   []byte
 	P      *InteriorNode
 	keyLen int
+
+	lock sync.Mutex
+	node Node
 }
 
-func (n *HashNode) encode() (key []byte, value []byte) {
+func newHashNode(p *InteriorNode, hash []byte, keyLen int) *HashNode {
+	return &HashNode{
+		Hash:   hash,
+		P:      p,
+		keyLen: keyLen,
+	}
+}
 
-	return
+// resolve loads the node, only once however many times it is called.
+func (n *HashNode) resolve(bt *BTree) (Node, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.node != nil {
+		return n.node, nil
+	}
+	node, err := bt.loadNode(n.Hash, n.P)
+	if err != nil {
+		return nil, err
+	}
+	node.setParent(n.P)
+	n.node = node
+	return node, nil
 }
 
-func (n *HashNode) decode(data []byte) {
+// loaded returns the node once it is loaded, or nil.
+func (n *HashNode) loaded() Node {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.node
+}
+
+func (n *HashNode) count() int { return 0 }
+
+func (n *HashNode) find(key []byte) (int, bool) { return 0, false }
+
+func (n *HashNode) parent() *InteriorNode { return n.P }
 
-	return
+func (n *HashNode) setParent(p *InteriorNode) {
+	n.P = p
+	if n.node != nil {
+		n.node.setParent(p)
+	}
 }
+
+func (n *HashNode) full() bool { return false }
+
+func (n *HashNode) isDirty() bool { return false }
+
+func (n *HashNode) setDirty(dirty bool) {}
+
+func (n *HashNode) cache() (bool, []byte, []byte) { return false, n.Hash, nil }
+
+func (n *HashNode) setCache(hash, data []byte) {}
+
+func (n *HashNode) largestKey() []byte { return nil }
+
+func (n *HashNode) encode() (value []byte) { return nil }
+
+func (n *HashNode) decode(data []byte) error { return nil }
@@ -3,15 +3,20 @@ package bplustree
 import (
 	"fmt"
 	"sort"
+	"sync"
 )
 
-//go:generate msgp
-
 type KC struct {
 	Key   []byte
 	Child Node
+	Size  int    // number of Keys under Child
+	Agg   []byte // aggregate of the KVs under Child, see Aggregator
 }
 
+// sizeUnknown is the Size of the KCs of the nodes stored before the Sizes and
+// Aggs, whose Aggs are unknown too.
+const sizeUnknown = -1
+
 type KCs struct {
 	data    []KC
 	cmpFunc func(key1, key2 []byte) int
@@ -41,7 +46,6 @@ func (a KCs) String() string {
 	return s
 }
 
-//msgp: tuple InteriorNode
 type InteriorNode struct {
 	Kcs   *KCs
 	Count int
@@ -52,6 +56,11 @@ type InteriorNode struct {
 	cacheHash []byte
 	cacheData []byte
 	dirty     bool
+	version   uint64
+	used      uint64
+	summed    bool // the Sizes and Aggs of the KCs are up to date
+
+	latch sync.RWMutex
 }
 
 func newInteriorNode(p *InteriorNode, largestChild Node, keyLen int, cmpFunc func(key1, key2 []byte) int) *InteriorNode {
@@ -87,17 +96,46 @@ func (in *InteriorNode) find(key []byte) (int, bool) {
 	return i, true
 }
 
+// findBefore returns the index of the child holding the largest Keys smaller
+// than key.
+func (in *InteriorNode) findBefore(key []byte) int {
+	c := func(i int) bool { return in.Kcs.cmpFunc(in.Kcs.data[i].Key, key) >= 0 }
+
+	return sort.Search(in.Count-1, c)
+}
+
 func (in *InteriorNode) count() int { return in.Count }
 
 func (in *InteriorNode) isDirty() bool { return in.dirty }
 
-func (in *InteriorNode) setDirty(dirty bool) { in.dirty = dirty }
+// setDirty sets the dirty flag of the node, every modification of the node
+// sets it, bumps the version of the node and invalidates the Sizes and Aggs
+// of its KCs.
+func (in *InteriorNode) setDirty(dirty bool) {
+	in.dirty = dirty
+	if dirty {
+		in.version++
+		in.summed = false
+	}
+}
 
 func (in *InteriorNode) cache() (bool, []byte, []byte) {
 	return in.dirty, in.cacheHash, in.cacheData
 }
 
-func (in *InteriorNode) largestKey() []byte { return in.Kcs.data[in.count()-1].Key }
+func (in *InteriorNode) setCache(hash, data []byte) {
+	in.cacheHash = hash
+	in.cacheData = data
+}
+
+// largestKey returns the upper bound of the Keys under the node, or nil if it
+// has no child.
+func (in *InteriorNode) largestKey() []byte {
+	if in.Count == 0 {
+		return nil
+	}
+	return in.Kcs.data[in.Count-1].Key
+}
 
 func (in *InteriorNode) full() bool { return in.Count == MaxKC }
 
@@ -107,7 +145,7 @@ func (in *InteriorNode) setParent(p *InteriorNode) { in.p = p }
 
 func (in *InteriorNode) insert(key []byte, child Node) ([]byte, *InteriorNode, bool) {
 	defer func(n *InteriorNode) {
-		n.dirty = true
+		n.setDirty(true)
 	}(in)
 
 	i, _ := in.find(key)
@@ -185,12 +223,88 @@ func (in *InteriorNode) encode() (value []byte) {
 		_, childHash, _ := kc.Child.cache()
 		value = append(value, Int32ToBytes(int32(len(childHash)))...)
 		value = append(value, childHash...)
+
+		// number of keys and aggregate under the child
+		value = append(value, Int64ToBytes(int64(kc.Size))...)
+		value = append(value, Int32ToBytes(int32(len(kc.Agg)))...)
+		value = append(value, kc.Agg...)
 	}
 
 	return value
 }
 
-func (in *InteriorNode) decode(data []byte) {
+func (in *InteriorNode) decode(data []byte) error {
+	return in.decodeKCs(data, true)
+}
+
+// decodeUnsized decodes a node stored before the Sizes and Aggs of the KCs,
+// which are left unknown.
+func (in *InteriorNode) decodeUnsized(data []byte) error {
+	return in.decodeKCs(data, false)
+}
+
+func (in *InteriorNode) decodeKCs(data []byte, sized bool) error {
+	if len(data) < 5 || data[0] != prefixInterior {
+		return ErrCorruptNode
+	}
+	count := int(BytesToInt32(data[1:]))
+	if count < 1 || count > MaxKC {
+		return ErrCorruptNode
+	}
+
+	var (
+		hash []byte
+		err  error
+	)
+	pos := 5
+	for i := 0; i < count; i++ {
+		kc := &in.Kcs.data[i]
+		if kc.Key, pos, err = readBytes(data, pos); err != nil {
+			return err
+		}
+		if hash, pos, err = readBytes(data, pos); err != nil {
+			return err
+		}
+		kc.Child = newHashNode(in, hash, in.keyLen)
+		if !sized {
+			kc.Size = sizeUnknown
+			continue
+		}
+		if pos+8 > len(data) {
+			return ErrCorruptNode
+		}
+		kc.Size = int(BytesToInt64(data[pos:]))
+		if kc.Agg, pos, err = readBytes(data, pos+8); err != nil {
+			return err
+		}
+		if len(kc.Agg) == 0 {
+			kc.Agg = nil
+		}
+	}
+	if pos != len(data) {
+		return ErrCorruptNode
+	}
+	in.Count = count
+	in.cacheData = data
+	in.dirty = false
+	return nil
+}
+
+// childIndex returns the index of child in the interior node, or -1 if
+// child is not a child of the node.
+func (in *InteriorNode) childIndex(child Node) int {
+	for i := 0; i < in.Count; i++ {
+		if in.Kcs.data[i].Child == child {
+			return i
+		}
+	}
+	return -1
+}
 
-	return
+// remove removes the KC at index i from the interior node.
+func (in *InteriorNode) remove(i int) {
+	copy(in.Kcs.data[i:], in.Kcs.data[i+1:in.Count])
+	in.Count--
+	in.Kcs.data[in.Count] = KC{}
+	in.setDirty(true)
 }
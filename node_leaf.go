@@ -3,23 +3,29 @@ package bplustree
 import (
 	"fmt"
 	"sort"
+	"sync"
 )
 
-//go:generate msgp
-
 type KV struct {
 	Key   []byte
 	Value []byte
 }
 
+// leafKV is a KV held by a leaf, along with the reference to the blob of its
+// Value if the Value is stored out of line.
+type leafKV struct {
+	KV
+	blob *blobRef // the Value is not in memory if nil
+}
+
 type KVs struct {
-	data    []KV
+	data    []leafKV
 	cmpFunc func(key1, key2 []byte) int
 }
 
 func newKVs(maxKV int, cmpFunc func(key1, key2 []byte) int) *KVs {
 	kvs := &KVs{}
-	kvs.data = make([]KV, maxKV)
+	kvs.data = make([]leafKV, maxKV)
 	kvs.cmpFunc = cmpFunc
 
 	return kvs
@@ -37,18 +43,28 @@ func (a KVs) String() string {
 	return s
 }
 
-//msgp: tuple LeafNode
 type LeafNode struct {
 	Kvs   *KVs
 	Count int
 
 	p      *InteriorNode
 	next   *LeafNode
+	prev   *LeafNode
 	keyLen int
 
 	cacheHash []byte
 	cacheData []byte
 	dirty     bool
+	version   uint64
+	used      uint64
+	queued    bool
+
+	// aggregate of the KVs, computed at version aggVersion
+	agg        []byte
+	aggVersion uint64
+	aggregated bool
+
+	latch sync.RWMutex
 }
 
 func newLeafNode(p *InteriorNode, keyLen int, cmpFunc func(key1, key2 []byte) int) *LeafNode {
@@ -95,20 +111,19 @@ func (l *LeafNode) findSmallest(key []byte) (int, bool) {
 // insert
 func (l *LeafNode) insert(key []byte, value []byte) ([]byte, bool) {
 	defer func(n *LeafNode) {
-		n.dirty = true
+		n.setDirty(true)
 	}(l)
 
 	i, ok := l.find(key)
 
 	if ok {
-		l.Kvs.data[i].Value = value
+		l.Kvs.data[i] = leafKV{KV: KV{key, value}}
 		return nil, false
 	}
 
 	if !l.full() {
 		copy(l.Kvs.data[i+1:], l.Kvs.data[i:l.Count])
-		l.Kvs.data[i].Key = key
-		l.Kvs.data[i].Value = value
+		l.Kvs.data[i] = leafKV{KV: KV{key, value}}
 		l.Count++
 		return nil, false
 	}
@@ -131,6 +146,7 @@ func (l *LeafNode) split() *LeafNode {
 
 	next.Count = MaxKV - l.Count/2 - 1
 	next.next = l.next
+	next.prev = l
 
 	l.Count = l.Count/2 + 1
 	l.next = next
@@ -142,13 +158,31 @@ func (l *LeafNode) count() int { return l.Count }
 
 func (l *LeafNode) isDirty() bool { return l.dirty }
 
-func (l *LeafNode) setDirty(dirty bool) { l.dirty = dirty }
+// setDirty sets the dirty flag of the node, every modification of the node
+// sets it and bumps the version of the node.
+func (l *LeafNode) setDirty(dirty bool) {
+	l.dirty = dirty
+	if dirty {
+		l.version++
+	}
+}
 
 func (l *LeafNode) cache() (bool, []byte, []byte) {
 	return l.dirty, l.cacheHash, l.cacheData
 }
 
-func (l *LeafNode) largestKey() []byte { return l.Kvs.data[l.count()-1].Key }
+func (l *LeafNode) setCache(hash, data []byte) {
+	l.cacheHash = hash
+	l.cacheData = data
+}
+
+// largestKey returns the largest Key of the leaf, or nil if it is empty.
+func (l *LeafNode) largestKey() []byte {
+	if l.Count == 0 {
+		return nil
+	}
+	return l.Kvs.data[l.Count-1].Key
+}
 
 func (l *LeafNode) full() bool { return l.Count == MaxKV }
 
@@ -175,9 +209,41 @@ func (l *LeafNode) encode() (value []byte) {
 	return value
 }
 
-func (l *LeafNode) decode(data []byte) {
+func (l *LeafNode) decode(data []byte) error {
+	if len(data) < 5 || data[0] != prefixLeaf {
+		return ErrCorruptNode
+	}
+	count := int(BytesToInt32(data[1:]))
+	if count < 0 || count > MaxKV {
+		return ErrCorruptNode
+	}
+
+	var err error
+	pos := 5
+	for i := 0; i < count; i++ {
+		kv := &l.Kvs.data[i]
+		if kv.Key, pos, err = readBytes(data, pos); err != nil {
+			return err
+		}
+		if kv.Value, pos, err = readBytes(data, pos); err != nil {
+			return err
+		}
+	}
+	if pos != len(data) {
+		return ErrCorruptNode
+	}
+	l.Count = count
+	l.cacheData = data
+	l.dirty = false
+	return nil
+}
 
-	return
+// remove removes the KV at index i from the leaf.
+func (l *LeafNode) remove(i int) {
+	copy(l.Kvs.data[i:], l.Kvs.data[i+1:l.Count])
+	l.Count--
+	l.Kvs.data[l.Count] = leafKV{}
+	l.setDirty(true)
 }
 
 func (l *LeafNode) MsgSize() (s int) {
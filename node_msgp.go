@@ -0,0 +1,112 @@
+package bplustree
+
+import "github.com/tinylib/msgp/msgp"
+
+//go:generate msgp -io=false -tests=false -unexported
+
+// The MessagePack encoding of a node is the type prefix of the node followed
+// by its msgLeaf or msgInterior, each struct being encoded as an array of its
+// fields.
+
+//msgp:tuple msgKV msgLeaf msgKC msgInterior
+
+type msgKV struct {
+	Key   []byte
+	Value []byte
+}
+
+type msgLeaf struct {
+	Kvs []msgKV
+}
+
+type msgKC struct {
+	Key   []byte
+	Child []byte
+	Size  int64
+	Agg   []byte
+}
+
+type msgInterior struct {
+	Kcs []msgKC
+}
+
+// msgpCodec encodes the nodes with the code generated by msgp from the
+// structs above.
+type msgpCodec struct{}
+
+func (msgpCodec) encodeLeaf(l *LeafNode) []byte {
+	m := msgLeaf{Kvs: make([]msgKV, l.Count)}
+	for i := 0; i < l.Count; i++ {
+		m.Kvs[i] = msgKV(l.Kvs.data[i].KV)
+	}
+	data, _ := m.MarshalMsg([]byte{prefixLeaf})
+	return data
+}
+
+func (msgpCodec) decodeLeaf(l *LeafNode, data []byte) error {
+	if err := checkMsgCount(data, prefixLeaf, 0, MaxKV); err != nil {
+		return err
+	}
+	var m msgLeaf
+	if rest, err := m.UnmarshalMsg(data[1:]); err != nil || len(rest) != 0 {
+		return ErrCorruptNode
+	}
+	for i, kv := range m.Kvs {
+		l.Kvs.data[i] = leafKV{KV: KV(kv)}
+	}
+	l.Count = len(m.Kvs)
+	l.cacheData = data
+	l.dirty = false
+	return nil
+}
+
+func (msgpCodec) encodeInterior(in *InteriorNode) []byte {
+	m := msgInterior{Kcs: make([]msgKC, in.Count)}
+	for i := 0; i < in.Count; i++ {
+		kc := in.Kcs.data[i]
+		_, childHash, _ := kc.Child.cache()
+		m.Kcs[i] = msgKC{Key: kc.Key, Child: childHash, Size: int64(kc.Size), Agg: kc.Agg}
+	}
+	data, _ := m.MarshalMsg([]byte{prefixInterior})
+	return data
+}
+
+func (msgpCodec) decodeInterior(in *InteriorNode, data []byte) error {
+	if err := checkMsgCount(data, prefixInterior, 1, MaxKC); err != nil {
+		return err
+	}
+	var m msgInterior
+	if rest, err := m.UnmarshalMsg(data[1:]); err != nil || len(rest) != 0 {
+		return ErrCorruptNode
+	}
+	for i, mkc := range m.Kcs {
+		kc := &in.Kcs.data[i]
+		kc.Key, kc.Size, kc.Agg = mkc.Key, int(mkc.Size), mkc.Agg
+		if len(kc.Agg) == 0 {
+			kc.Agg = nil
+		}
+		kc.Child = newHashNode(in, mkc.Child, in.keyLen)
+	}
+	in.Count = len(m.Kcs)
+	in.cacheData = data
+	in.dirty = false
+	return nil
+}
+
+// checkMsgCount checks the type prefix of the MessagePack encoding of a node,
+// and that the node has between min and max entries, before the entries are
+// allocated.
+func checkMsgCount(data []byte, prefix byte, min, max int) error {
+	if len(data) == 0 || data[0] != prefix {
+		return ErrCorruptNode
+	}
+	fields, rest, err := msgp.ReadArrayHeaderBytes(data[1:])
+	if err != nil || fields != 1 {
+		return ErrCorruptNode
+	}
+	count, _, err := msgp.ReadArrayHeaderBytes(rest)
+	if err != nil || int(count) < min || int(count) > max {
+		return ErrCorruptNode
+	}
+	return nil
+}
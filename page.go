@@ -0,0 +1,159 @@
+package bplustree
+
+const cursorVersion = 1
+
+const (
+	cursorReverse = 1 << iota
+	cursorBound
+	cursorStart
+	cursorEnd
+)
+
+// cursor is the state of a paginated range query, encoded in the opaque
+// cursors returned to the callers.
+type cursor struct {
+	reverse bool
+	root    []byte // committed root the pages are read from, or nil
+	start   []byte
+	end     []byte
+	last    []byte // Key of the last KV returned
+}
+
+func (c *cursor) encode() []byte {
+	flags := byte(0)
+	if c.reverse {
+		flags |= cursorReverse
+	}
+	if c.root != nil {
+		flags |= cursorBound
+	}
+	if c.start != nil {
+		flags |= cursorStart
+	}
+	if c.end != nil {
+		flags |= cursorEnd
+	}
+	b := []byte{cursorVersion, flags}
+	for _, field := range [][]byte{c.root, c.start, c.end, c.last} {
+		b = append(b, Int32ToBytes(int32(len(field)))...)
+		b = append(b, field...)
+	}
+	return b
+}
+
+func decodeCursor(data []byte) (*cursor, error) {
+	if len(data) < 2 || data[0] != cursorVersion {
+		return nil, ErrInvalidCursor
+	}
+	flags := data[1]
+	var fields [4][]byte
+	pos := 2
+	for i := range fields {
+		var err error
+		if fields[i], pos, err = readBytes(data, pos); err != nil {
+			return nil, ErrInvalidCursor
+		}
+	}
+	if pos != len(data) {
+		return nil, ErrInvalidCursor
+	}
+	c := &cursor{reverse: flags&cursorReverse != 0, last: fields[3]}
+	if flags&cursorBound != 0 {
+		c.root = fields[0]
+	}
+	if flags&cursorStart != 0 {
+		c.start = fields[1]
+	}
+	if flags&cursorEnd != 0 {
+		c.end = fields[2]
+	}
+	return c, nil
+}
+
+// SearchRangePage returns at most limit KVs with start <= Key <= end, from
+// start, or from end when reverse is set, and a cursor to the next page which
+// is nil when there are no KVs left. A nil end, or a nil start when reverse is
+// set, leaves the range unbounded, and a limit <= 0 returns the whole range.
+//
+// The next page, given by NextPage, resumes right after the last Key of the
+// page, so KVs inserted or deleted in between are seen or not depending on
+// their Keys but never make a page skip or repeat a KV.
+func (bt *BTree) SearchRangePage(start, end []byte, limit int, reverse bool) ([]KV, []byte, error) {
+	return bt.page(bt, &cursor{reverse: reverse, start: start, end: end}, limit)
+}
+
+// SearchCommittedRangePage is SearchRangePage on the last committed tree. The
+// cursor is bound to the root hash of the tree, so that the next pages are
+// read from the same tree whatever is committed in between.
+func (bt *BTree) SearchCommittedRangePage(start, end []byte, limit int, reverse bool) ([]KV, []byte, error) {
+	bt.lockTree()
+	root := bt.committed
+	bt.unlockTree()
+	if root == nil {
+		return nil, nil, ErrNotCommitted
+	}
+	c := &cursor{reverse: reverse, root: root, start: start, end: end}
+	tree, err := bt.committedTree(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bt.page(tree, c, limit)
+}
+
+// NextPage returns at most limit KVs following the page of cursor, and a
+// cursor to the next page which is nil when there are no KVs left.
+func (bt *BTree) NextPage(cursor []byte, limit int) ([]KV, []byte, error) {
+	c, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, nil, err
+	}
+	tree := bt
+	if c.root != nil {
+		if tree, err = bt.committedTree(c.root); err != nil {
+			return nil, nil, err
+		}
+	}
+	return bt.page(tree, c, limit)
+}
+
+// committedTree loads the tree committed with root, sharing the node cache of
+// the tree.
+func (bt *BTree) committedTree(root []byte) (*BTree, error) {
+	return LoadBTree(bt.db, root, bt.keyLen, bt.cmpFunc, WithNodeCache(bt.cache), WithAggregator(bt.aggregator))
+}
+
+// page reads the page following c from tree.
+func (bt *BTree) page(tree *BTree, c *cursor, limit int) ([]KV, []byte, error) {
+	var it *Iterator
+	if !c.reverse {
+		from := c.start
+		if c.last != nil {
+			from = c.last
+		}
+		it = tree.Iterate(from, c.end)
+	} else {
+		to := c.end
+		if c.last != nil {
+			to = c.last
+		}
+		it = tree.IterateReverse(c.start, to)
+	}
+
+	kvs := make([]KV, 0)
+	for (limit <= 0 || len(kvs) < limit) && it.Next() {
+		if c.last != nil && bt.cmpFunc(it.Key(), c.last) == 0 {
+			continue
+		}
+		kvs = append(kvs, KV{it.Key(), it.Value()})
+	}
+	if it.Err() != nil {
+		return nil, nil, it.Err()
+	}
+	if len(kvs) == 0 || !it.Next() {
+		return kvs, nil, it.Err()
+	}
+
+	next := *c
+	next.last = kvs[len(kvs)-1].Key
+	return kvs, next.encode(), nil
+}
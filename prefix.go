@@ -0,0 +1,76 @@
+package bplustree
+
+import "bytes"
+
+// PrefixSuccessor returns the smallest Key larger than all the Keys starting
+// with prefix under the cmpFunc of the tree, or nil if there is none. The
+// Keys starting with prefix must be exactly the Keys from prefix, included,
+// to the successor, excluded, as they are with bytes.Compare, so that the
+// prefix operations read and drop the subtrees in between as a range.
+type PrefixSuccessor func(prefix []byte) []byte
+
+// WithPrefixSuccessor gives the PrefixSuccessor of the order of the tree to
+// the prefix operations, which need one unless the tree is ordered by
+// bytes.Compare.
+func WithPrefixSuccessor(s PrefixSuccessor) Option {
+	return func(bt *BTree) {
+		bt.succFunc = s
+	}
+}
+
+// ScanPrefix returns an Iterator over the KVs whose Key starts with prefix.
+// The Iterator fails with ErrPrefixOrder if the tree has no PrefixSuccessor
+// and is not ordered by bytes.Compare.
+func (bt *BTree) ScanPrefix(prefix []byte) *Iterator {
+	r, err := bt.prefixRange(prefix)
+	if err != nil {
+		return &Iterator{bt: bt, err: err, pos: -1}
+	}
+	return &Iterator{bt: bt, start: r.start, before: r.end, prefix: prefix, pos: -1}
+}
+
+// DeletePrefix deletes all the Keys starting with prefix, and returns the
+// number of Keys deleted. The subtrees holding only such Keys are dropped at
+// once, without being loaded. It returns ErrPrefixOrder if the tree has no
+// PrefixSuccessor and is not ordered by bytes.Compare.
+func (bt *BTree) DeletePrefix(prefix []byte) (int, error) {
+	defer bt.evictIfNeeded()
+	bt.lockTree()
+	defer bt.unlockTree()
+
+	r, err := bt.prefixRange(prefix)
+	if err != nil {
+		return 0, err
+	}
+	return bt.deleteLogged(r)
+}
+
+// prefixRange returns the range of the Keys starting with prefix.
+func (bt *BTree) prefixRange(prefix []byte) (keyRange, error) {
+	switch {
+	case bt.succFunc != nil:
+		return keyRange{start: prefix, end: bt.succFunc(prefix), prefix: true}, nil
+	case isBytesCompare(bt.cmpFunc):
+		return keyRange{start: prefix, end: prefixEnd(prefix), prefix: true}, nil
+	default:
+		return keyRange{}, ErrPrefixOrder
+	}
+}
+
+// isBytesCompare reports whether cmp is bytes.Compare.
+func isBytesCompare(cmp func(key1, key2 []byte) int) bool {
+	return sameCmp(cmp, bytes.Compare)
+}
+
+// prefixEnd returns the smallest Key greater than all the Keys starting with
+// prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := CopyBytes(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
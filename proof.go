@@ -0,0 +1,176 @@
+package bplustree
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Proof holds the encoded nodes read by a query on a committed tree. As the
+// nodes are addressed by their hashes, a verifier knowing the root hash of the
+// tree runs the query again on the nodes of the proof, and gets the same
+// result only if the proof holds the nodes of the tree.
+type Proof struct {
+	Nodes [][]byte
+	Blobs [][]byte // Values stored out of line, see ProveSearch
+}
+
+// database returns a db holding the nodes of the proof under their hashes,
+// computed over the canonical form of each node with the hasher named in its
+// header.
+func (p *Proof) database() *MemDatabase {
+	db := NewMemDatabase()
+	for _, node := range p.Nodes {
+		canonical, err := canonicalNode(node)
+		if err != nil {
+			continue
+		}
+		db.Put(headerOf(node).hasher.sum(canonical), node)
+	}
+	return db
+}
+
+// proofRecorder records the nodes read from a db.
+type proofRecorder struct {
+	Database
+
+	lock  sync.Mutex
+	nodes map[string][]byte
+}
+
+func newProofRecorder(db Database) *proofRecorder {
+	return &proofRecorder{Database: db, nodes: make(map[string][]byte)}
+}
+
+func (r *proofRecorder) Get(key []byte) ([]byte, error) {
+	data, err := r.Database.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	r.lock.Lock()
+	r.nodes[string(key)] = data
+	r.lock.Unlock()
+	return data, nil
+}
+
+func (r *proofRecorder) proof() *Proof {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	p := &Proof{}
+	for _, node := range r.nodes {
+		p.Nodes = append(p.Nodes, node)
+	}
+	return p
+}
+
+// ProveSearch searches key in the last committed tree, and returns its Value
+// along with a proof of it, or of its absence, for the root hash of the tree,
+// to be checked by VerifySearch. The blob of a Value stored out of line is
+// part of the proof only if withBlob is set, a verifier holding the Value
+// doesn't need it to check the Value against its hash, see VerifyValue.
+func (bt *BTree) ProveSearch(key []byte, withBlob bool) ([]byte, bool, *Proof, error) {
+	bt.lockTree()
+	root := bt.committed
+	bt.unlockTree()
+	if root == nil {
+		return nil, false, nil, ErrNotCommitted
+	}
+
+	rec := newProofRecorder(bt.db)
+	committed, err := openBTree(rec, root, bt.keyLen, bt.cmpFunc)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	kv, found, err := committed.find(key)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	if !found {
+		return nil, false, rec.proof(), nil
+	}
+	proof := rec.proof()
+
+	// the blob is read from db, so as not to be recorded as a node
+	committed.db = bt.db
+	value, err := committed.value(kv)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	if withBlob && kv.blob != nil {
+		proof.Blobs = append(proof.Blobs, value)
+	}
+	return value, true, proof, nil
+}
+
+// find returns the KV of key, without reading its Value if it is stored out
+// of line.
+func (bt *BTree) find(key []byte) (leafKV, bool, error) {
+	if len(key) > bt.keyLen {
+		return leafKV{}, false, ErrKeyTooLong
+	}
+	leaf, _, err := bt.seekLeaf(key)
+	if err != nil {
+		return leafKV{}, false, err
+	}
+	defer bt.runlatch(leaf)
+
+	i, ok := leaf.find(key)
+	if !ok {
+		return leafKV{}, false, nil
+	}
+	return leaf.Kvs.data[i], true, nil
+}
+
+// VerifySearch returns the Value of key in the tree committed with root, read
+// from the nodes of proof, and false if the tree doesn't hold key. It returns
+// ErrInvalidProof if the proof doesn't prove the Value of key, or its absence,
+// including when the Value is stored out of line and its blob is not part of
+// the proof.
+func VerifySearch(root, key []byte, proof *Proof, keyLen int, cmpFunc func(key1, key2 []byte) int) ([]byte, bool, error) {
+	db := proof.database()
+	bt, err := openBTree(db, root, keyLen, cmpFunc)
+	if err != nil {
+		return nil, false, ErrInvalidProof
+	}
+	for _, blob := range proof.Blobs {
+		db.Put(bt.hasher.sum(blob), blob)
+	}
+	kv, found, err := bt.find(key)
+	if err != nil {
+		return nil, false, ErrInvalidProof
+	}
+	if !found {
+		return nil, false, nil
+	}
+	value, err := bt.value(kv)
+	if err != nil {
+		return nil, false, ErrInvalidProof
+	}
+	return value, true, nil
+}
+
+// VerifyValue checks that value is the Value of key in the tree committed with
+// root, from the nodes of proof. A Value stored out of line is checked against
+// the hash and the size of its blob held by its leaf, the blob itself is not
+// needed. It returns ErrInvalidProof if value is not proven to be the Value
+// of key.
+func VerifyValue(root, key, value []byte, proof *Proof, keyLen int, cmpFunc func(key1, key2 []byte) int) error {
+	bt, err := openBTree(proof.database(), root, keyLen, cmpFunc)
+	if err != nil {
+		return ErrInvalidProof
+	}
+	kv, found, err := bt.find(key)
+	if err != nil || !found {
+		return ErrInvalidProof
+	}
+	if kv.blob == nil || kv.Value != nil {
+		if !bytes.Equal(kv.Value, value) {
+			return ErrInvalidProof
+		}
+		return nil
+	}
+	if len(value) != kv.blob.size || !bytes.Equal(bt.hasher.sum(value), kv.blob.hash) {
+		return ErrInvalidProof
+	}
+	return nil
+}
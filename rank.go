@@ -0,0 +1,125 @@
+package bplustree
+
+// Every KC of an interior node records the number of Keys under its child,
+// which is committed with the node. The Sizes of a dirty node are brought up
+// to date lazily by summarize, along with the aggregates, so that the order
+// statistics are computed from the root down to a single leaf. The nodes
+// stored before the Sizes have none, their Sizes are counted by loading the
+// subtrees of their children the first time they are needed, until the tree
+// is migrated, see Migrate.
+
+// size returns the number of Keys under in, the tree must be locked.
+func (bt *BTree) size(in *InteriorNode) (int, error) {
+	size, _, err := bt.summarize(in)
+	return size, err
+}
+
+// Len returns the number of Keys in the tree.
+func (bt *BTree) Len() (int, error) {
+	defer bt.evictIfNeeded()
+	bt.lockTree()
+	defer bt.unlockTree()
+
+	return bt.size(bt.root)
+}
+
+// Rank returns the number of Keys smaller than key, which is the index of key
+// in the tree if it exists.
+func (bt *BTree) Rank(key []byte) (int, error) {
+	defer bt.evictIfNeeded()
+	bt.lockTree()
+	defer bt.unlockTree()
+
+	return bt.rank(key, false)
+}
+
+// CountRange returns the number of Keys with start <= Key <= end.
+func (bt *BTree) CountRange(start, end []byte) (int, error) {
+	defer bt.evictIfNeeded()
+	bt.lockTree()
+	defer bt.unlockTree()
+
+	from, err := bt.rank(start, false)
+	if err != nil {
+		return 0, err
+	}
+	to, err := bt.rank(end, true)
+	if err != nil || to < from {
+		return 0, err
+	}
+	return to - from, nil
+}
+
+// rank returns the number of Keys smaller than key, or not larger than key if
+// inclusive is set.
+func (bt *BTree) rank(key []byte, inclusive bool) (int, error) {
+	rank := 0
+	in := bt.root
+	for {
+		if _, err := bt.size(in); err != nil {
+			return 0, err
+		}
+		i, _ := in.find(key)
+		for j := 0; j < i; j++ {
+			rank += in.Kcs.data[j].Size
+		}
+		child, err := bt.child(in, i)
+		if err != nil {
+			return 0, err
+		}
+		switch c := child.(type) {
+		case *LeafNode:
+			j, ok := c.find(key)
+			if ok && inclusive {
+				j++
+			}
+			return rank + j, nil
+		case *InteriorNode:
+			in = c
+		default:
+			return 0, ErrCorruptNode
+		}
+	}
+}
+
+// Select returns the KV at index i in the tree, the KVs being indexed from 0
+// in Key order. It returns ErrOutOfRange if i is not in [0, Len()).
+func (bt *BTree) Select(i int) (KV, error) {
+	defer bt.evictIfNeeded()
+	bt.lockTree()
+	defer bt.unlockTree()
+
+	size, err := bt.size(bt.root)
+	if err != nil {
+		return KV{}, err
+	}
+	if i < 0 || i >= size {
+		return KV{}, ErrOutOfRange
+	}
+	in := bt.root
+	for {
+		if _, err := bt.size(in); err != nil {
+			return KV{}, err
+		}
+		j := 0
+		for ; j < in.Count-1 && i >= in.Kcs.data[j].Size; j++ {
+			i -= in.Kcs.data[j].Size
+		}
+		child, err := bt.child(in, j)
+		if err != nil {
+			return KV{}, err
+		}
+		switch c := child.(type) {
+		case *LeafNode:
+			if i >= c.Count {
+				return KV{}, ErrCorruptNode
+			}
+			kv, _, err := bt.resolveKV(c.Kvs.data[i], true, nil)
+			return kv, err
+		case *InteriorNode:
+			in = c
+		default:
+			return KV{}, ErrCorruptNode
+		}
+	}
+}
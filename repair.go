@@ -0,0 +1,94 @@
+package bplustree
+
+import "bytes"
+
+// WithReplica makes the tree repair the nodes, and the blobs, it reads from
+// db missing or corrupt: they are read from replica, a db holding the same
+// nodes, checked, and written back to db. The nodes missing or corrupt in the
+// replica as well fail to load.
+func WithReplica(replica Database) Option {
+	return func(bt *BTree) {
+		bt.replica = replica
+	}
+}
+
+// read returns the data stored under hash in db, once check accepts it. Data
+// missing, failing to read, or rejected by check with ErrCorruptNode, is read
+// from the replica of the tree if it has one.
+func (bt *BTree) read(hash []byte, check func(data []byte) error) ([]byte, error) {
+	data, err := bt.db.Get(hash)
+	if err != nil {
+		if ok, _ := bt.db.Has(hash); !ok {
+			err = ErrMissingNode
+		}
+	} else {
+		err = check(data)
+	}
+	if err == nil || err == ErrUnsupportedFormat || bt.replica == nil {
+		return data, err
+	}
+
+	data, rerr := bt.replica.Get(hash)
+	if rerr != nil || check(data) != nil {
+		return nil, err
+	}
+	// the repair of db is best effort, the data read from the replica is good
+	// whether it is written back or not
+	bt.db.Put(hash, data)
+	return data, nil
+}
+
+// readNode reads the node stored under hash, and returns it along with its
+// header and its uncompressed encoding, decompressed once for both the check
+// and the decoding of the node. The node is checked to hash to hash, computed
+// over its canonical form with hasher, or with the hasher named in its header
+// if hasher is 0. A node hashed with another hasher, or in an unknown format,
+// fails with ErrUnsupportedFormat.
+func (bt *BTree) readNode(hash []byte, hasher Hasher) ([]byte, nodeHeader, []byte, error) {
+	var (
+		h       nodeHeader
+		payload []byte
+	)
+	data, err := bt.read(hash, func(data []byte) error {
+		var err error
+		if h, payload, err = readHeader(data); err != nil {
+			return err
+		}
+		if hasher != 0 && h.hasher != hasher {
+			return ErrUnsupportedFormat
+		}
+		if payload, err = decompress(h.compression, payload); err != nil {
+			return err
+		}
+		if !bytes.Equal(h.hasher.sum(canonicalForm(data, h, payload)), hash) {
+			return ErrCorruptNode
+		}
+		return nil
+	})
+	return data, h, payload, err
+}
+
+// nodeError returns the error of the node stored under hash, at path.
+func nodeError(hash []byte, path [][]byte, err error) error {
+	if err == ErrCorruptNode {
+		return &CorruptNodeError{Hash: CopyBytes(hash), Path: path}
+	}
+	return &NodeError{Hash: CopyBytes(hash), Err: err}
+}
+
+// pathOf returns the hashes of the nodes from the root down to p, the hash of
+// a node modified since it was loaded being nil.
+func pathOf(p *InteriorNode) [][]byte {
+	var path [][]byte
+	for ; p != nil; p = p.p {
+		dirty, hash, _ := p.cache()
+		if dirty {
+			hash = nil
+		}
+		path = append(path, CopyBytes(hash))
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
@@ -0,0 +1,40 @@
+package bplustree
+
+// Separator returns a Key s with left < s <= right under the cmpFunc of the
+// tree, for Keys left < right, as short as possible. The interior nodes hold
+// the separators of their children, which route the Keys smaller than them
+// to the left and the others to the right, so the shorter the separators, the
+// smaller the interior nodes and the proofs.
+type Separator func(left, right []byte) []byte
+
+// ShortestSeparator returns the shortest prefix of right which is larger than
+// left, it is the Separator of the trees ordered by bytes.Compare, or by any
+// lexicographic order of the bytes.
+func ShortestSeparator(left, right []byte) []byte {
+	n := 0
+	for n < len(left) && n < len(right) && left[n] == right[n] {
+		n++
+	}
+	if n >= len(right) {
+		return right
+	}
+	return right[: n+1 : n+1]
+}
+
+// WithSeparator makes the tree separate its leaves with the Keys returned by
+// s when they are split or rebalanced, instead of the smallest Key of the
+// right leaf.
+func WithSeparator(s Separator) Option {
+	return func(bt *BTree) {
+		bt.sepFunc = s
+	}
+}
+
+// separator returns the Key separating the leaves whose largest and smallest
+// Keys are left and right.
+func (bt *BTree) separator(left, right []byte) []byte {
+	if bt.sepFunc == nil {
+		return right
+	}
+	return bt.sepFunc(left, right)
+}
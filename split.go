@@ -0,0 +1,507 @@
+package bplustree
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+)
+
+// Split cuts every node on the path to the pivot Key in two pieces, the
+// children on each side of the path, and joins the pieces of each side back
+// together. Joining a shorter subtree to a taller one attaches its root to the
+// node of the facing spine of the taller one whose children have its height,
+// then rebalances it with its new sibling, so that Split and Join only read
+// and modify O(height) nodes.
+
+// subtree is a detached node with the height of its subtree, 1 for a leaf,
+// and an upper bound of its Keys.
+type subtree struct {
+	n      Node
+	height int
+	hi     []byte
+}
+
+// cut is an interior node on the path to the pivot Key, with the index of the
+// child on the path, the height of the node and the bounds [lo, hi) of its
+// Keys.
+type cut struct {
+	in     *InteriorNode
+	i      int
+	height int
+	lo     []byte
+	hi     []byte
+}
+
+// piece is a subtree cut from the tree, with the Key separating it from the
+// subtrees it is joined to.
+type piece struct {
+	subtree
+	sep []byte
+}
+
+// Split splits the tree into a left tree holding the Keys smaller than key,
+// and a right tree holding the other Keys, which share the db and the options
+// of the tree. The tree must not be used once split, and a WAL attached to it
+// is not carried over to the new trees. All the nodes Split reads are loaded
+// before the tree is modified, so that an error leaves it unchanged.
+func (bt *BTree) Split(key []byte) (left, right *BTree, err error) {
+	bt.lockTree()
+	defer bt.unlockTree()
+
+	if bt.tx != nil {
+		return nil, nil, ErrTxInProgress
+	}
+	if len(key) > bt.keyLen {
+		return nil, nil, ErrKeyTooLong
+	}
+	path, leaf, lo, hi, err := bt.loadCut(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	top := bt.root.largestKey()
+
+	// the KVs from key on move to a new leaf
+	i, _ := leaf.findSmallest(key)
+	next := newLeafNode(nil, bt.keyLen, bt.cmpFunc)
+	next.Count = copy(next.Kvs.data, leaf.Kvs.data[i:leaf.Count])
+	clearKVs(leaf.Kvs.data, i, leaf.Count)
+	leaf.Count = i
+	leaf.setDirty(true)
+	leaf.setParent(nil)
+
+	// the chain of leaves is cut between the two leaves, the empty ones are
+	// dropped
+	if leaf.next != nil {
+		leaf.next.prev = nil
+		if next.Count > 0 {
+			next.next, leaf.next.prev = leaf.next, next
+		}
+		leaf.next = nil
+	}
+	if leaf.Count == 0 && leaf.prev != nil {
+		leaf.prev.next = nil
+	}
+
+	var lefts, rights []piece
+	for _, c := range path {
+		in := c.in
+		if c.i < in.Count-1 {
+			r := newInteriorNode(nil, nil, bt.keyLen, bt.cmpFunc)
+			r.Count = copy(r.Kcs.data, in.Kcs.data[c.i+1:in.Count])
+			for j := 0; j < r.Count; j++ {
+				r.Kcs.data[j].Child.setParent(r)
+			}
+			rights = append(rights, piece{strip(subtree{r, c.height, c.hi}), in.Kcs.data[c.i].Key})
+		}
+		if c.i > 0 {
+			clearKCs(in.Kcs.data, c.i, in.Count)
+			in.Count = c.i
+			in.setDirty(true)
+			lefts = append(lefts, piece{strip(subtree{in, c.height, in.largestKey()}), c.lo})
+		}
+	}
+
+	var l, r subtree
+	for _, p := range lefts {
+		if l, err = bt.join(l, p.subtree, p.sep); err != nil {
+			return nil, nil, err
+		}
+	}
+	if leaf.Count > 0 {
+		if l, err = bt.join(l, subtree{leaf, 1, key}, lo); err != nil {
+			return nil, nil, err
+		}
+	}
+	if next.Count > 0 {
+		r = subtree{next, 1, hi}
+	}
+	for j := len(rights) - 1; j >= 0; j-- {
+		if r, err = bt.join(r, rights[j].subtree, rights[j].sep); err != nil {
+			return nil, nil, err
+		}
+	}
+	return bt.derive(l, top), bt.derive(r, top), nil
+}
+
+// loadCut loads the path to key, along with the nodes right before and right
+// after the path on every level, which are the nodes the pieces cut from the
+// path are joined and rebalanced with. It returns the path, and the leaf of
+// key with its bounds [lo, hi).
+func (bt *BTree) loadCut(key []byte) ([]cut, *LeafNode, []byte, []byte, error) {
+	var (
+		path          []cut
+		lo            []byte
+		hi            = bt.root.largestKey()
+		before, after Node
+		n             Node = bt.root
+		err           error
+	)
+	for height := bt.height; ; height-- {
+		in, ok := n.(*InteriorNode)
+		if !ok {
+			break
+		}
+		i, _ := in.find(key)
+		path = append(path, cut{in, i, height, lo, hi})
+
+		if n, err = bt.child(in, i); err != nil {
+			return nil, nil, nil, nil, err
+		}
+		if before, err = bt.sideChild(in, i-1, before); err != nil {
+			return nil, nil, nil, nil, err
+		}
+		if after, err = bt.sideChild(in, i+1, after); err != nil {
+			return nil, nil, nil, nil, err
+		}
+		if i > 0 {
+			lo = in.Kcs.data[i-1].Key
+		}
+		if i < in.Count-1 {
+			hi = in.Kcs.data[i].Key
+		}
+	}
+	leaf, ok := n.(*LeafNode)
+	if !ok {
+		return nil, nil, nil, nil, ErrCorruptNode
+	}
+	return path, leaf, lo, hi, nil
+}
+
+// sideChild returns the child at index i of in if there is one, or else the
+// child of side, the node next to in on the same level, which is next to the
+// children of in: its last child when i is before the first child of in, and
+// its first child otherwise. It returns nil if side is nil.
+func (bt *BTree) sideChild(in *InteriorNode, i int, side Node) (Node, error) {
+	if i >= 0 && i < in.Count {
+		return bt.child(in, i)
+	}
+	s, ok := side.(*InteriorNode)
+	if !ok {
+		return nil, nil
+	}
+	if i < 0 {
+		return bt.child(s, s.Count-1)
+	}
+	return bt.child(s, 0)
+}
+
+// loadSpine loads the leftmost path of the tree, or the rightmost one when
+// last is set, and returns its leaf.
+func (bt *BTree) loadSpine(last bool) (*LeafNode, error) {
+	var n Node = bt.root
+	for {
+		in, ok := n.(*InteriorNode)
+		if !ok {
+			break
+		}
+		i := 0
+		if last {
+			i = in.Count - 1
+		}
+		child, err := bt.child(in, i)
+		if err != nil {
+			return nil, err
+		}
+		n = child
+	}
+	leaf, ok := n.(*LeafNode)
+	if !ok {
+		return nil, ErrCorruptNode
+	}
+	return leaf, nil
+}
+
+// strip replaces an interior node with a single child by the child, which
+// must be loaded, and detaches the resulting node.
+func strip(s subtree) subtree {
+	for s.height > 1 {
+		in, ok := s.n.(*InteriorNode)
+		if !ok || in.Count > 1 {
+			break
+		}
+		s.n = in.Kcs.data[0].Child
+		s.height--
+	}
+	s.n.setParent(nil)
+	return s
+}
+
+// join joins the subtrees a and b, whose Keys are smaller than sep and larger
+// than or equal to sep respectively, and returns the joined subtree. A nil
+// subtree is empty. The nodes of the facing spines of a and b down to the
+// height of the shorter one, and the one below, must be loaded.
+func (bt *BTree) join(a, b subtree, sep []byte) (subtree, error) {
+	if a.n == nil {
+		return b, nil
+	}
+	if b.n == nil {
+		return a, nil
+	}
+	if a.height == b.height {
+		root := newInteriorNode(nil, nil, bt.keyLen, bt.cmpFunc)
+		root.Kcs.data[0] = KC{Key: a.hi, Child: a.n}
+		a.n.setParent(root)
+		a = subtree{root, a.height + 1, a.hi}
+	}
+
+	var (
+		attached Node
+		grown    bool
+		height   int
+	)
+	if a.height > b.height {
+		// b becomes the last child of the node of the right spine of a
+		// whose children have its height
+		x := a.n.(*InteriorNode)
+		for h := a.height; ; h-- {
+			x.Kcs.data[x.Count-1].Key = b.hi
+			if h == b.height+1 {
+				break
+			}
+			child, err := bt.child(x, x.Count-1)
+			if err != nil {
+				return subtree{}, err
+			}
+			if x, _ = child.(*InteriorNode); x == nil {
+				return subtree{}, ErrCorruptNode
+			}
+		}
+		last := x.Kcs.data[x.Count-1].Child
+		x.Kcs.data[x.Count-1].Child = b.n
+		b.n.setParent(x)
+		markPathDirty(x)
+		bound(last, sep)
+		attached, grown, height = b.n, bt.insertChild(x, sep, last), a.height
+		if err := bt.summarizeChild(last); err != nil {
+			return subtree{}, err
+		}
+	} else {
+		// a becomes the first child of the node of the left spine of b
+		// whose children have its height
+		y := b.n.(*InteriorNode)
+		for h := b.height; h > a.height+1; h-- {
+			child, err := bt.child(y, 0)
+			if err != nil {
+				return subtree{}, err
+			}
+			if y, _ = child.(*InteriorNode); y == nil {
+				return subtree{}, ErrCorruptNode
+			}
+		}
+		markPathDirty(y)
+		bound(a.n, sep)
+		attached, grown, height = a.n, bt.insertChild(y, sep, a.n), b.height
+	}
+	if err := bt.summarizeChild(attached); err != nil {
+		return subtree{}, err
+	}
+	if grown {
+		height++
+	}
+
+	p := attached.parent()
+	if err := bt.rebalanceChildren(p); err != nil {
+		return subtree{}, err
+	}
+	for p.parent() != nil {
+		p = p.parent()
+	}
+	return strip(subtree{p, height, b.hi}), nil
+}
+
+// bound sets the last Keys of the right spine of n, as far as it is loaded,
+// to key, the new upper bound of the Keys of n.
+func bound(n Node, key []byte) {
+	for in, ok := n.(*InteriorNode); ok; in, ok = in.Kcs.data[in.Count-1].Child.(*InteriorNode) {
+		if kc := &in.Kcs.data[in.Count-1]; !bytes.Equal(kc.Key, key) {
+			kc.Key = key
+			markPathDirty(in)
+		}
+	}
+}
+
+// summarizeChild sets the Size and the Agg of the KC of n in its parent, for n
+// moved to a new KC.
+func (bt *BTree) summarizeChild(n Node) error {
+	p := n.parent()
+	kc := &p.Kcs.data[p.childIndex(n)]
+	switch node := n.(type) {
+	case *LeafNode:
+		kc.Size, kc.Agg = node.Count, bt.aggregateLeaf(node)
+	case *InteriorNode:
+		size, agg, err := bt.summarize(node)
+		if err != nil {
+			return err
+		}
+		kc.Size, kc.Agg = size, agg
+	}
+	return nil
+}
+
+// joinLock serializes the joins.
+var joinLock sync.Mutex
+
+// sameDB reports whether db1 and db2 are the same db, without panicking on
+// the dbs whose type is not comparable.
+func sameDB(db1, db2 Database) bool {
+	t := reflect.TypeOf(db1)
+	if t != reflect.TypeOf(db2) || (t != nil && !t.Comparable()) {
+		return false
+	}
+	return db1 == db2
+}
+
+// sameCmp reports whether cmp1 and cmp2 are the same function.
+func sameCmp(cmp1, cmp2 func(key1, key2 []byte) int) bool {
+	return reflect.ValueOf(cmp1).Pointer() == reflect.ValueOf(cmp2).Pointer()
+}
+
+// insertChild inserts child into in, with the upper bound key of its Keys,
+// splitting in and its ancestors while they are full. It returns true if the
+// topmost ancestor of in has been split under a new root.
+func (bt *BTree) insertChild(in *InteriorNode, key []byte, child Node) bool {
+	for {
+		p := in.parent()
+		mid, next, split := in.insert(key, child)
+		if !split {
+			return false
+		}
+		if p == nil {
+			root := newInteriorNode(nil, next, bt.keyLen, bt.cmpFunc)
+			next.setParent(root)
+			root.insert(mid, in)
+			return true
+		}
+		p.Kcs.data[p.childIndex(in)].Child = next
+		next.setParent(p)
+		p.setDirty(true)
+		in, key, child = p, mid, in
+	}
+}
+
+// Join joins the trees left and right, whose Keys must all be smaller than
+// the Keys of right, into a tree with the db and the options of left, even if
+// one of them is empty. The trees must share their db, Key length and
+// cmpFunc, Join returns ErrIncompatibleTrees if they don't, and ErrSameTree if
+// left is right. The dbs are compared with ==, a db whose type is not
+// comparable, such as a struct holding a map, is shared with no other tree.
+// The trees must not be used once joined, the WALs attached to them are not
+// carried over. The facing spines of the trees are loaded before they are
+// modified, so that an error leaves them unchanged.
+func Join(left, right *BTree) (*BTree, error) {
+	if left == right {
+		return nil, ErrSameTree
+	}
+	if !sameDB(left.db, right.db) || left.keyLen != right.keyLen || !sameCmp(left.cmpFunc, right.cmpFunc) {
+		return nil, ErrIncompatibleTrees
+	}
+
+	// the joins lock their two trees one after the other, one join at a
+	// time, so that two joins of the same trees can't wait for each other
+	joinLock.Lock()
+	defer joinLock.Unlock()
+	left.lockTree()
+	defer left.unlockTree()
+	right.lockTree()
+	defer right.unlockTree()
+
+	if left.tx != nil || right.tx != nil {
+		return nil, ErrTxInProgress
+	}
+	max, ok, err := left.max()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		top := right.root.largestKey()
+		return left.derive(subtree{right.root, right.height, top}, top), nil
+	}
+	min, ok, err := right.min()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		top := left.root.largestKey()
+		return left.derive(subtree{left.root, left.height, top}, top), nil
+	}
+	if left.cmpFunc(max.Key, min.Key) >= 0 {
+		return nil, ErrOverlap
+	}
+
+	last, err := left.loadSpine(true)
+	if err != nil {
+		return nil, err
+	}
+	first, err := right.loadSpine(false)
+	if err != nil {
+		return nil, err
+	}
+	last.next, first.prev = first, last
+
+	top := right.root.largestKey()
+	a := strip(subtree{left.root, left.height, left.root.largestKey()})
+	b := strip(subtree{right.root, right.height, top})
+	s, err := left.join(a, b, left.separator(max.Key, min.Key))
+	if err != nil {
+		return nil, err
+	}
+	return left.derive(s, top), nil
+}
+
+// derive returns a tree with the db and the options of bt, made of the nodes
+// of s, whose largest Keys are smaller than top.
+func (bt *BTree) derive(s subtree, top []byte) *BTree {
+	t := &BTree{
+		db:          bt.db,
+		keyLen:      bt.keyLen,
+		cmpFunc:     bt.cmpFunc,
+		concurrent:  bt.concurrent,
+		cache:       bt.cache,
+		aggregator:  bt.aggregator,
+		hasher:      bt.hasher,
+		encoding:    bt.encoding,
+		encodingSet: bt.encodingSet,
+		sepFunc:     bt.sepFunc,
+		succFunc:    bt.succFunc,
+		memLimit:    bt.memLimit,
+
+		compression:       bt.compression,
+		compressThreshold: bt.compressThreshold,
+		blobThreshold:     bt.blobThreshold,
+		replica:           bt.replica,
+	}
+
+	if s.n == nil {
+		s = subtree{newLeafNode(nil, bt.keyLen, bt.cmpFunc), 1, top}
+	}
+	if leaf, ok := s.n.(*LeafNode); ok {
+		t.root = newInteriorNode(nil, leaf, bt.keyLen, bt.cmpFunc)
+		leaf.setParent(t.root)
+		bt.summarizeChild(leaf)
+		t.height = 2
+	} else {
+		t.root = s.n.(*InteriorNode)
+		t.height = s.height
+	}
+
+	// the last Keys of the right spine are the upper bound of all the Keys,
+	// which the Keys inserted later must not exceed
+	bound(t.root, top)
+
+	// a root left clean is the root of the last commit of the tree
+	if dirty, hash, _ := t.root.cache(); !dirty {
+		t.committed = hash
+	}
+	t.leaf, t.interior = countLoaded(t.root)
+	for n := Node(t.root); t.first == nil; {
+		switch node := n.(type) {
+		case *InteriorNode:
+			n = node.Kcs.data[0].Child
+		case *LeafNode:
+			t.first = node
+		default:
+			return t
+		}
+	}
+	return t
+}
@@ -1,28 +1,81 @@
 package bplustree
 
 import (
-	"golang.org/x/crypto/sha3"
+	"errors"
+	"sync"
+	"sync/atomic"
 )
 
 type BTree struct {
 	db Database
 
-	root    *InteriorNode
-	first   *LeafNode
-	dirties []*dirtyNode
+	root      *InteriorNode
+	first     *LeafNode
+	dirties   []*dirtyNode
+	committed []byte
+	wal       *WAL
+	tx        *Tx
+	cache     *NodeCache
 
-	leaf     int
-	interior int
+	leaf     int // number of loaded leaf nodes
+	interior int // number of loaded interior nodes
 	height   int
 	keyLen   int
 	cmpFunc  func(key1, key2 []byte) int
+
+	// concurrent mode, see WithConcurrency
+	concurrent  bool
+	treeLock    sync.RWMutex
+	rootLatch   sync.RWMutex
+	countLock   sync.Mutex
+	pendingLock sync.Mutex
+	pending     []*LeafNode
+	commitLock  sync.Mutex
+	committing  bool
+
+	aggregator  Aggregator
+	hasher      Hasher
+	encoding    Encoding
+	encodingSet bool // encoding given by WithEncoding, else the one of the root
+	sepFunc     Separator
+	succFunc    PrefixSuccessor
+
+	// Values larger than blobThreshold are stored out of line, see WithBlobs
+	blobThreshold int
+
+	// compression of the stored nodes, see WithCompression
+	compression       Compression
+	compressThreshold int
+
+	// replica repairing the nodes read from db, see WithReplica
+	replica Database
+
+	// memory limit, see WithMemoryLimit
+	memLimit int64
+	loaded   int64
+	kept     int64
+	clock    uint64
+}
+
+// Option configures a BTree on creation.
+type Option func(bt *BTree)
+
+// WithConcurrency makes the tree safe for concurrent use. Insert, Delete,
+// Search and SearchRange latch the nodes on their way down the tree and
+// release the latches of the ancestors as soon as a node can't be split or
+// merged by the operation, so that they run in parallel. Every other
+// operation locks the whole tree.
+func WithConcurrency() Option {
+	return func(bt *BTree) {
+		bt.concurrent = true
+	}
 }
 
-func NewBTree(db Database, keyLen int, cmpFunc func(key1, key2 []byte) int) *BTree {
+func NewBTree(db Database, keyLen int, cmpFunc func(key1, key2 []byte) int, opts ...Option) *BTree {
 	leaf := newLeafNode(nil, keyLen, cmpFunc)
 	r := newInteriorNode(nil, leaf, keyLen, cmpFunc)
 	leaf.p = r
-	return &BTree{
+	bt := &BTree{
 		db:       db,
 		root:     r,
 		first:    leaf,
@@ -32,29 +85,307 @@ func NewBTree(db Database, keyLen int, cmpFunc func(key1, key2 []byte) int) *BTr
 		keyLen:   keyLen,
 		cmpFunc:  cmpFunc,
 	}
+	for _, opt := range opts {
+		opt(bt)
+	}
+	if bt.hasher == 0 {
+		bt.hasher = SHA3
+	}
+	return bt
+}
+
+// LoadBTree loads the tree committed with root hash from db.
+func LoadBTree(db Database, root []byte, keyLen int, cmpFunc func(key1, key2 []byte) int, opts ...Option) (*BTree, error) {
+	bt, err := openBTree(db, root, keyLen, cmpFunc, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// resolve the leftmost path, which gives the height and the first leaf,
+	// the other nodes are loaded the first time they are needed
+	bt.height = 1
+	for in := bt.root; ; bt.height++ {
+		child, err := bt.child(in, 0)
+		if err != nil {
+			return nil, err
+		}
+		if leaf, ok := child.(*LeafNode); ok {
+			bt.first = leaf
+			bt.height++
+			break
+		}
+		next, ok := child.(*InteriorNode)
+		if !ok {
+			return nil, ErrCorruptNode
+		}
+		in = next
+	}
+	return bt, nil
+}
+
+// openBTree loads only the root node of the tree committed with root hash
+// from db, every other node is loaded the first time it is needed. The height
+// of the tree is left unknown, so the tree only serves searches, as the ones
+// of the proofs, which read nothing but the nodes on the paths they follow.
+func openBTree(db Database, root []byte, keyLen int, cmpFunc func(key1, key2 []byte) int, opts ...Option) (*BTree, error) {
+	bt := &BTree{
+		db:      db,
+		keyLen:  keyLen,
+		cmpFunc: cmpFunc,
+	}
+	for _, opt := range opts {
+		opt(bt)
+	}
+
+	n, err := bt.loadNode(root, nil)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := n.(*InteriorNode)
+	if !ok {
+		return nil, nodeError(root, nil, ErrCorruptNode)
+	}
+	_, _, data := r.cache()
+	h := headerOf(data)
+	if bt.hasher == 0 {
+		bt.hasher = h.hasher
+	}
+	if !bt.encodingSet {
+		bt.encoding = h.encoding
+	}
+	bt.root = r
+	bt.interior = 1
+	bt.committed = CopyBytes(root)
+	return bt, nil
+}
+
+// loadNode reads and decodes the node stored under hash, from the node cache
+// if there is one, p being the parent of the node. The node is checked to hash
+// to hash, and a node hashed with another hasher than the one of the tree
+// fails to load.
+func (bt *BTree) loadNode(hash []byte, p *InteriorNode) (Node, error) {
+	if bt.cache != nil {
+		if n, ok := bt.cache.get(hash); ok {
+			_, _, data := n.cache()
+			atomic.AddInt64(&bt.loaded, int64(len(data)))
+			return n, nil
+		}
+	}
+
+	data, h, payload, err := bt.readNode(hash, bt.hasher)
+	if err != nil {
+		return nil, nodeError(hash, pathOf(p), err)
+	}
+	n, err := decodePayload(h, payload, bt.keyLen, bt.cmpFunc)
+	if err != nil {
+		return nil, nodeError(hash, pathOf(p), err)
+	}
+	n.setCache(CopyBytes(hash), data)
+	atomic.AddInt64(&bt.loaded, int64(len(data)))
+
+	if bt.cache != nil {
+		bt.cache.add(hash, n, len(data))
+		n = cloneNode(n)
+	}
+	return n, nil
+}
+
+// child returns the child at index i of in, loading it if it is unresolved.
+// The loaded node replaces the placeholder in in, unless the caller may only
+// hold a read latch on in.
+func (bt *BTree) child(in *InteriorNode, i int) (Node, error) {
+	return bt.resolveChild(in, i, true)
+}
+
+func (bt *BTree) resolveChild(in *InteriorNode, i int, write bool) (Node, error) {
+	hn, ok := in.Kcs.data[i].Child.(*HashNode)
+	if !ok {
+		return in.Kcs.data[i].Child, nil
+	}
+	n, err := hn.resolve(bt)
+	if err != nil {
+		return nil, err
+	}
+	bt.use(n)
+	if !write && bt.concurrent {
+		return n, nil
+	}
+
+	in.Kcs.data[i].Child = n
+	switch node := n.(type) {
+	case *LeafNode:
+		bt.addNodes(1, 0)
+		if !bt.concurrent {
+			linkLeaf(node)
+		}
+	case *InteriorNode:
+		bt.addNodes(0, 1)
+	}
+	return n, nil
+}
+
+// linkLeaf chains a leaf which has just been loaded to its neighbours, if
+// they are loaded too.
+func linkLeaf(l *LeafNode) {
+	l.prev = loadedLeaf(l, -1)
+	if l.prev != nil {
+		l.prev.next = l
+	}
+	l.next = loadedLeaf(l, 1)
+	if l.next != nil {
+		l.next.prev = l
+	}
+}
+
+// loadedLeaf returns the leaf right after n when dir is 1, or right before n
+// when dir is -1, without loading any node. It returns nil if that leaf is
+// not loaded or doesn't exist.
+func loadedLeaf(n Node, dir int) *LeafNode {
+	for {
+		p := n.parent()
+		if p == nil {
+			return nil
+		}
+		i := p.childIndex(n) + dir
+		if i < 0 || i >= p.Count {
+			n = p
+			continue
+		}
+
+		c := p.Kcs.data[i].Child
+		for {
+			switch t := c.(type) {
+			case *LeafNode:
+				return t
+			case *InteriorNode:
+				if dir > 0 {
+					c = t.Kcs.data[0].Child
+				} else {
+					c = t.Kcs.data[t.Count-1].Child
+				}
+			default:
+				return nil
+			}
+		}
+	}
 }
 
 // first returns the first LeafNode
-func (bt *BTree) First() *LeafNode {
-	return bt.first
+func (bt *BTree) First() (*LeafNode, error) {
+	if bt.first == nil {
+		var n Node = bt.root
+		for {
+			in, ok := n.(*InteriorNode)
+			if !ok {
+				break
+			}
+			child, err := bt.child(in, 0)
+			if err != nil {
+				return nil, err
+			}
+			n = child
+		}
+		leaf, ok := n.(*LeafNode)
+		if !ok {
+			return nil, ErrCorruptNode
+		}
+		bt.first = leaf
+	}
+	return bt.first, nil
 }
 
-// insert inserts a (Key, Value) into the B+ tree
-func (bt *BTree) Insert(key []byte, value []byte) {
-	_, oldIndex, _, leaf := search(bt.root, key, true)
-	p := leaf.parent()
+// RootHash returns the root hash of the last commit, or nil if the tree has
+// never been committed.
+func (bt *BTree) RootHash() []byte {
+	return bt.committed
+}
+
+// AttachWAL replays the updates logged in w on top of the tree and logs all
+// the following updates to w until the next commit. The tree should be the
+// one of the last commit made while w was attached.
+func (bt *BTree) AttachWAL(w *WAL) error {
+	bt.lockTree()
+	defer bt.unlockTree()
+
+	err := w.replay(func(op byte, key, value []byte) error {
+		switch op {
+		case walInsert:
+			return bt.insert(key, value)
+		case walDelete:
+			_, err := bt.delete(key)
+			return err
+		case walDeleteRange:
+			r, err := decodeKeyRange(key, value)
+			if err != nil {
+				return err
+			}
+			_, err = bt.deleteRange(r)
+			return err
+		default:
+			return errors.New("unknown wal op")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	bt.wal = w
+	return nil
+}
+
+// log appends an update to the attached WAL, updates made by a transaction are
+// logged when it commits.
+func (bt *BTree) log(op byte, key, value []byte) error {
+	if bt.wal == nil || bt.tx != nil {
+		return nil
+	}
+	return bt.wal.append(op, key, value)
+}
+
+// insert inserts a (Key, Value) into the B+ tree. It returns ErrKeyTooLong if
+// the Key is longer than the Key length of the tree, or the error of loading
+// a node on the way to the Key, in which case the tree is left unchanged.
+func (bt *BTree) Insert(key []byte, value []byte) error {
+	defer bt.evictIfNeeded()
+	bt.rlockTree()
+	defer bt.runlockTree()
+
+	return bt.insert(key, value)
+}
 
+func (bt *BTree) insert(key []byte, value []byte) error {
+	if len(key) > bt.keyLen {
+		return ErrKeyTooLong
+	}
+	leaf, held, err := bt.lockPath(key, insertSafe)
+	defer bt.unlockPath(held)
+	if err != nil {
+		return err
+	}
+
+	if err := bt.log(walInsert, key, value); err != nil {
+		return err
+	}
+
+	bt.touchPath(leaf)
 	mid, bump := leaf.insert(key, value)
+	bt.dirtyPath(leaf)
 	if !bump {
-		return
+		return nil
 	}
-	bt.leaf++
+	mid = bt.separator(leaf.largestKey(), mid)
+	p := leaf.parent()
+	oldIndex, _ := p.find(key)
+	bt.addNodes(1, 0)
 
 	var midNode Node
 	midNode = leaf
 
 	p.Kcs.data[oldIndex].Child = leaf.next
 	leaf.next.setParent(p)
+	if !bt.concurrent && leaf.next.next != nil {
+		bt.touch(leaf.next.next)
+		leaf.next.next.prev = leaf.next
+	}
 
 	interior, interiorP := p, p.parent()
 
@@ -67,12 +398,15 @@ func (bt *BTree) Insert(key []byte, value []byte) {
 		if !isRoot {
 			oldIndex, _ = interiorP.find(key)
 		}
+		if interior.full() {
+			bt.touchChildren(interior)
+		}
 
 		mid, newNode, bump = interior.insert(mid, midNode)
 		if !bump {
-			return
+			return nil
 		}
-		bt.interior++
+		bt.addNodes(0, 1)
 
 		if !isRoot {
 			interiorP.Kcs.data[oldIndex].Child = newNode
@@ -84,48 +418,304 @@ func (bt *BTree) Insert(key []byte, value []byte) {
 			newNode.setParent(bt.root)
 
 			bt.root.insert(mid, interior)
-			bt.interior++
+			bt.addNodes(0, 1)
 			bt.height++
-			return
+			return nil
 		}
 
 		interior, interiorP = interiorP, interiorP.parent()
 	}
 }
 
+// Delete deletes the Key from the B+ tree, it returns false if the Key does
+// not exist. A node that fails to load on the way to the Key leaves the tree
+// unchanged, while a sibling that fails to load once the Key is deleted
+// leaves the node it should have been merged with underfilled.
+func (bt *BTree) Delete(key []byte) (bool, error) {
+	defer bt.evictIfNeeded()
+	bt.rlockTree()
+	defer bt.runlockTree()
+
+	return bt.delete(key)
+}
+
+func (bt *BTree) delete(key []byte) (bool, error) {
+	if len(key) > bt.keyLen {
+		return false, ErrKeyTooLong
+	}
+	leaf, held, err := bt.lockPath(key, deleteSafe)
+	defer bt.unlockPath(held)
+	if err != nil {
+		return false, err
+	}
+
+	if err := bt.log(walDelete, key, nil); err != nil {
+		return false, err
+	}
+	index, ok := leaf.find(key)
+	if !ok {
+		return false, nil
+	}
+
+	bt.touchPath(leaf)
+	leaf.remove(index)
+	bt.dirtyPath(leaf)
+
+	var n Node = leaf
+	for underflow(n) {
+		p := n.parent()
+		if p == nil || p.Count == 1 {
+			break
+		}
+		if err := bt.rebalance(p, p.childIndex(n)); err != nil {
+			return true, err
+		}
+		n = p
+	}
+
+	// shrink the tree while the root has a single interior child, the root
+	// can only shrink when it is latched by the operation.
+	if held != nil && !held.root {
+		return true, nil
+	}
+	for bt.root.Count == 1 {
+		child, ok := bt.root.Kcs.data[0].Child.(*InteriorNode)
+		if !ok {
+			break
+		}
+		child.setParent(nil)
+		bt.root = child
+		bt.addNodes(0, -1)
+		bt.height--
+	}
+	return true, nil
+}
+
+func underflow(n Node) bool {
+	switch n.(type) {
+	case *LeafNode:
+		return n.count() < MaxKV/2
+	case *InteriorNode:
+		return n.count() < MaxKC/2
+	default:
+		return false
+	}
+}
+
+// rebalance fixes the underflowed child at index i of p, by merging it with
+// a sibling or moving KVs/KCs from a sibling when both can't fit in one node.
+func (bt *BTree) rebalance(p *InteriorNode, i int) error {
+	s := i + 1
+	if s == p.Count {
+		s = i - 1
+		i = s
+	}
+	sibling, err := bt.child(p, s)
+	if err != nil {
+		return err
+	}
+	bt.latch(sibling)
+	defer bt.unlatch(sibling)
+
+	bt.touch(p.Kcs.data[i].Child)
+	bt.touch(p.Kcs.data[i+1].Child)
+	if left, ok := p.Kcs.data[i].Child.(*InteriorNode); ok {
+		bt.touchChildren(left)
+		bt.touchChildren(p.Kcs.data[i+1].Child.(*InteriorNode))
+	}
+
+	switch left := p.Kcs.data[i].Child.(type) {
+	case *LeafNode:
+		right := p.Kcs.data[i+1].Child.(*LeafNode)
+		all := make([]leafKV, 0, left.Count+right.Count)
+		all = append(all, left.Kvs.data[:left.Count]...)
+		all = append(all, right.Kvs.data[:right.Count]...)
+
+		if len(all) <= MaxKV {
+			copy(left.Kvs.data, all)
+			left.Count = len(all)
+			left.next = right.next
+			if !bt.concurrent && right.next != nil {
+				bt.touch(right.next)
+				right.next.prev = left
+			}
+			p.Kcs.data[i].Key = p.Kcs.data[i+1].Key
+			p.remove(i + 1)
+			bt.addNodes(-1, 0)
+		} else {
+			mid := len(all) / 2
+			copy(left.Kvs.data, all[:mid])
+			clearKVs(left.Kvs.data, mid, left.Count)
+			copy(right.Kvs.data, all[mid:])
+			clearKVs(right.Kvs.data, len(all)-mid, right.Count)
+			left.Count, right.Count = mid, len(all)-mid
+			right.setDirty(true)
+			p.Kcs.data[i].Key = bt.separator(left.largestKey(), right.Kvs.data[0].Key)
+		}
+		left.setDirty(true)
+
+	case *InteriorNode:
+		right := p.Kcs.data[i+1].Child.(*InteriorNode)
+		all := make([]KC, 0, left.Count+right.Count)
+		all = append(all, left.Kcs.data[:left.Count]...)
+		all = append(all, right.Kcs.data[:right.Count]...)
+
+		if len(all) <= MaxKC {
+			copy(left.Kcs.data, all)
+			left.Count = len(all)
+			for _, kc := range all {
+				kc.Child.setParent(left)
+			}
+			p.Kcs.data[i].Key = p.Kcs.data[i+1].Key
+			p.remove(i + 1)
+			bt.addNodes(0, -1)
+		} else {
+			mid := len(all) / 2
+			copy(left.Kcs.data, all[:mid])
+			clearKCs(left.Kcs.data, mid, left.Count)
+			copy(right.Kcs.data, all[mid:])
+			clearKCs(right.Kcs.data, len(all)-mid, right.Count)
+			left.Count, right.Count = mid, len(all)-mid
+			for _, kc := range all[:mid] {
+				kc.Child.setParent(left)
+			}
+			for _, kc := range all[mid:] {
+				kc.Child.setParent(right)
+			}
+			right.setDirty(true)
+			p.Kcs.data[i].Key = left.largestKey()
+		}
+		left.setDirty(true)
+	}
+	p.setDirty(true)
+	return nil
+}
+
+// clearKVs clears the slots [from, to) of kvs, which are no longer in use.
+func clearKVs(kvs []leafKV, from, to int) {
+	for i := from; i < to; i++ {
+		kvs[i] = leafKV{}
+	}
+}
+
+// clearKCs clears the slots [from, to) of kcs, which are no longer in use.
+func clearKCs(kcs []KC, from, to int) {
+	for i := from; i < to; i++ {
+		kcs[i] = KC{}
+	}
+}
+
 // Search searches the Key in B+ tree
 // If the Key exists, it returns the Value of Key and true
 // If the Key does not exist, it returns an empty string and false
-func (bt *BTree) Search(key []byte) ([]byte, bool) {
-	kv, _, _, _ := search(bt.root, key, true)
-	if kv == nil {
-		return nil, false
+func (bt *BTree) Search(key []byte) ([]byte, bool, error) {
+	defer bt.evictIfNeeded()
+	bt.rlockTree()
+	defer bt.runlockTree()
+
+	return bt.get(key)
+}
+
+func (bt *BTree) get(key []byte) ([]byte, bool, error) {
+	if len(key) > bt.keyLen {
+		return nil, false, ErrKeyTooLong
+	}
+	leaf, _, err := bt.seekLeaf(key)
+	if err != nil {
+		return nil, false, err
 	}
-	return kv.Value, true
+	defer bt.runlatch(leaf)
+
+	i, ok := leaf.find(key)
+	if !ok {
+		return nil, false, nil
+	}
+	value, err := bt.value(leaf.Kvs.data[i])
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// SearchRange returns all the KVs with start <= Key <= end.
+func (bt *BTree) SearchRange(start, end []byte) ([]KV, error) {
+	defer bt.evictIfNeeded()
+	bt.rlockTree()
+	defer bt.runlockTree()
+
+	return bt.searchRange(start, end)
 }
 
-func (bt *BTree) SearchRange(start, end []byte) []KV {
-	return searchRange(bt.root, start, end)
+// searchRange collects the KVs one leaf at a time, each leaf is reached from
+// the root by seeking the lower bound of the KVs it holds, so the scan never
+// relies on the chaining of leaves.
+func (bt *BTree) searchRange(start, end []byte) ([]KV, error) {
+	result := make([]leafKV, 0)
+
+	for {
+		leaf, bound, err := bt.seekLeaf(start)
+		if err != nil {
+			return nil, err
+		}
+		i, _ := leaf.findSmallest(start)
+		for ; i < leaf.Count; i++ {
+			kv := leaf.Kvs.data[i]
+			if bt.cmpFunc(kv.Key, end) > 0 {
+				bt.runlatch(leaf)
+				return bt.resolvedKVs(result)
+			}
+			result = append(result, kv)
+		}
+		bt.runlatch(leaf)
+
+		if bound == nil || bt.cmpFunc(bound, end) > 0 {
+			return bt.resolvedKVs(result)
+		}
+		start = bound
+	}
 }
 
-// Commit flush all the dirty nodes to db.
+// Commit flush all the dirty nodes to db through batch. The batch is written
+// before Commit returns, a nil batch is replaced by a new batch of the tree's db.
+//
+// The tree is only locked while the dirty nodes are frozen and once they are
+// written, while they are hashed and written the tree keeps serving searches
+// and updates, which are left to the next commit.
 func (bt *BTree) Commit(batch Batch) error {
+	defer bt.trim()
+	bt.commitLock.Lock()
+	defer bt.commitLock.Unlock()
+
+	bt.lockTree()
 	if !bt.root.isDirty() {
+		defer bt.unlockTree()
+		if bt.wal != nil {
+			return bt.wal.truncate()
+		}
 		return nil
 	}
+	frozen, err := bt.freeze()
+	if err != nil {
+		bt.unlockTree()
+		return err
+	}
+	bt.committing = true
+	bt.unlockTree()
 
-	bt.dirties = make([]*dirtyNode, 0)
-	hashNode(bt.root, bt)
+	err = bt.writeFrozen(frozen, batch)
 
-	//batch := bt.db.NewBatch()
-	for _, dirty := range bt.dirties {
-		//batch.Put(dirty.hash, dirty.data)
-		if err := batch.Put(dirty.hash, dirty.data); err != nil {
-			return err
-		}
-		dirty.origin.setDirty(false)
+	bt.lockTree()
+	defer bt.unlockTree()
+	bt.committing = false
+	if err != nil {
+		bt.dirties = nil
+		return err
+	}
+	root := bt.publish(frozen)
+	bt.committed = root
+	if bt.wal != nil {
+		return bt.wal.truncateBefore(frozen.walOffset)
 	}
-	//return batch.Write()
 	return nil
 }
 
@@ -157,8 +747,21 @@ func (bt *BTree) String() string {
 	return s
 }
 
-func search(n Node, key []byte, exact bool) (*KV, int, int, *LeafNode) {
-	curr := n
+// markPathDirty marks n and all its ancestors dirty, so that the next commit
+// rehashes every node from the root down to n.
+func markPathDirty(n Node) {
+	for {
+		n.setDirty(true)
+		p := n.parent()
+		if p == nil {
+			return
+		}
+		n = p
+	}
+}
+
+func (bt *BTree) search(key []byte, exact bool) (*leafKV, int, int, *LeafNode, error) {
+	var curr Node = bt.root
 	oldIndex := -1
 
 	for {
@@ -172,40 +775,22 @@ func search(n Node, key []byte, exact bool) (*KV, int, int, *LeafNode) {
 			}
 			i, ok := explorer(key)
 			if !ok {
-				return nil, oldIndex, 0, t
+				return nil, oldIndex, 0, t, nil
 			}
-			return &t.Kvs.data[i], oldIndex, i, t
+			return &t.Kvs.data[i], oldIndex, i, t, nil
 		case *InteriorNode:
+			bt.use(t)
 			i, _ := t.find(key)
-			curr = t.Kcs.data[i].Child
+			child, err := bt.child(t, i)
+			if err != nil {
+				return nil, oldIndex, 0, nil, err
+			}
+			curr = child
 			oldIndex = i
 		default:
-			panic("")
-		}
-	}
-}
-
-func searchRange(n Node, start, end []byte) []KV {
-	result := make([]KV, 0)
-
-	_, _, index, leaf := search(n, start, false)
-	for {
-		if leaf == nil {
-			return result
-		}
-		if index == leaf.count() {
-			index = 0
-			leaf = leaf.next
-			continue
-		}
-		kv := leaf.Kvs.data[index]
-		if leaf.Kvs.cmpFunc(kv.Key, end) > 0 {
-			return result
+			return nil, oldIndex, 0, nil, ErrCorruptNode
 		}
-		result = append(result, kv)
-		index++
 	}
-
 }
 
 type dirtyNode struct {
@@ -234,23 +819,28 @@ func hashNode(n Node, tree *BTree) []byte {
 			hashNode(kc.Child, tree)
 		}
 
-		data := node.encode()
-		hash := sha3.Sum256(data)
+		data, _ := tree.encodeNode(node)
+		hash := tree.hasher.sum(data)
+		data = tree.compressNode(data)
 
-		node.cacheHash = hash[:]
+		node.cacheHash = hash
 		node.cacheData = data
 
-		tree.appendDirty(hash[:], data, node)
-		return hash[:]
+		tree.appendDirty(hash, data, node)
+		return hash
 	case *LeafNode:
-		data := node.encode()
-		hash := sha3.Sum256(data)
+		data, blobs := tree.encodeNode(node)
+		hash := tree.hasher.sum(data)
+		data = tree.compressNode(data)
+		for _, blob := range blobs {
+			tree.appendDirty(tree.hasher.sum(blob), blob, nil)
+		}
 
-		node.cacheHash = hash[:]
+		node.cacheHash = hash
 		node.cacheData = data
 
-		tree.appendDirty(hash[:], data, node)
-		return hash[:]
+		tree.appendDirty(hash, data, node)
+		return hash
 	default:
 		return nil
 	}
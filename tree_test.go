@@ -2,9 +2,18 @@ package bplustree
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/sha3"
 )
 
 var (
@@ -49,7 +58,7 @@ func TestSearch(t *testing.T) {
 
 	start := time.Now()
 	for i := 1; i < testCount; i++ {
-		v, ok := bt.Search(Int64ToBytes(int64(i)))
+		v, ok, _ := bt.Search(Int64ToBytes(int64(i)))
 		if !ok {
 			t.Errorf("search: want = true, got = false")
 		}
@@ -74,6 +83,16 @@ func verifyTree(b *BTree, count int, t *testing.T) {
 	}
 
 	verifyLeaf(leftMost, count, t)
+
+	// the leaves are chained both ways, except in concurrent mode
+	if !b.concurrent {
+		for l := leftMost; l.next != nil; l = l.next {
+			if l.next.prev != l {
+				t.Errorf("leaf.prev: want = %p, got = %p", l, l.next.prev)
+				break
+			}
+		}
+	}
 }
 
 // min Child: 1
@@ -156,6 +175,19 @@ func verifyLeaf(leftMost *LeafNode, count int, t *testing.T) {
 	}
 }
 
+// resolveAll loads all the descendants of in.
+func resolveAll(bt *BTree, in *InteriorNode, t *testing.T) {
+	for i := 0; i < in.Count; i++ {
+		child, err := bt.child(in, i)
+		if err != nil {
+			t.Fatalf("resolve: %v", err)
+		}
+		if c, ok := child.(*InteriorNode); ok {
+			resolveAll(bt, c, t)
+		}
+	}
+}
+
 func findLeftMost(n Node) *LeafNode {
 	switch nn := n.(type) {
 	case *InteriorNode:
@@ -166,3 +198,2880 @@ func findLeftMost(n Node) *LeafNode {
 		panic("")
 	}
 }
+
+func TestCommit(t *testing.T) {
+	db := NewMemDatabase()
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare)
+
+	for i := 0; i < 10000; i++ {
+		bt.Insert(Int64ToBytes(int64(i)), []byte(fmt.Sprintf("%d", i)))
+	}
+	if err := bt.Commit(nil); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if bt.root.isDirty() {
+		t.Errorf("root.dirty: want = false, got = true")
+	}
+	root := bt.root.cacheHash
+	if ok, _ := db.Has(root); !ok {
+		t.Errorf("db.Has(root): want = true, got = false")
+	}
+	stored := db.Len()
+
+	bt.Insert(Int64ToBytes(5000), []byte("updated"))
+	batch := db.NewBatch()
+	if err := bt.Commit(batch); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if bytes.Equal(root, bt.root.cacheHash) {
+		t.Errorf("root hash unchanged after update")
+	}
+	// only the updated leaf and its ancestors are rewritten
+	if got := db.Len() - stored; got != bt.height {
+		t.Errorf("new nodes: want = %d, got = %d", bt.height, got)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	db := NewMemDatabase()
+	db.Put([]byte("a"), []byte("1"))
+
+	batch := db.NewBatch()
+	batch.Put([]byte("b"), []byte("2"))
+	batch.Delete([]byte("a"))
+	if db.Len() != 1 {
+		t.Errorf("db.Len before write: want = 1, got = %d", db.Len())
+	}
+	if err := batch.Write(); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if ok, _ := db.Has([]byte("a")); ok {
+		t.Errorf("db.Has(a): want = false, got = true")
+	}
+
+	replica := NewMemDatabase()
+	replica.Put([]byte("a"), []byte("1"))
+	if err := batch.Replay(replica); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if v, _ := replica.Get([]byte("b")); string(v) != "2" {
+		t.Errorf("replica.Get(b): want = 2, got = %s", v)
+	}
+	if ok, _ := replica.Has([]byte("a")); ok {
+		t.Errorf("replica.Has(a): want = false, got = true")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	testCount := 100000
+	bt := NewBTree(newMemDB(), defaultKeyLength, bytes.Compare)
+
+	for i := 0; i < testCount; i++ {
+		bt.Insert(Int64ToBytes(int64(i)), []byte(fmt.Sprintf("%d", i)))
+	}
+	for i := 0; i < testCount; i += 2 {
+		if ok, _ := bt.Delete(Int64ToBytes(int64(i))); !ok {
+			t.Errorf("delete %d: want = true, got = false", i)
+		}
+	}
+	if ok, _ := bt.Delete(Int64ToBytes(0)); ok {
+		t.Errorf("delete missing: want = false, got = true")
+	}
+	verifyTree(bt, testCount/2, t)
+
+	for i := 0; i < testCount; i++ {
+		_, ok, _ := bt.Search(Int64ToBytes(int64(i)))
+		if ok != (i%2 == 1) {
+			t.Errorf("search %d: want = %v, got = %v", i, i%2 == 1, ok)
+		}
+	}
+
+	for i := 1; i < testCount; i += 2 {
+		bt.Delete(Int64ToBytes(int64(i)))
+	}
+	if bt.height != 2 || bt.leaf != 1 || bt.first.Count != 0 {
+		t.Errorf("empty tree: height = %d, leaf = %d, count = %d", bt.height, bt.leaf, bt.first.Count)
+	}
+}
+
+func TestPrefixOrder(t *testing.T) {
+	// the prefix operations need a PrefixSuccessor unless the tree is
+	// ordered by bytes.Compare
+	reversed := func(key1, key2 []byte) int { return bytes.Compare(key2, key1) }
+	bt := NewBTree(NewMemDatabase(), defaultKeyLength, reversed)
+	for _, key := range []string{"a", "ab", "abc", "b"} {
+		bt.Insert([]byte(key), []byte("v"))
+	}
+	if n, err := bt.DeletePrefix([]byte("ab")); n != 0 || err != ErrPrefixOrder {
+		t.Errorf("delete prefix without successor: want = %v, got = %d, %v", ErrPrefixOrder, n, err)
+	}
+	it := bt.ScanPrefix([]byte("a"))
+	if it.Next() || it.Err() != ErrPrefixOrder {
+		t.Errorf("scan prefix without successor: want = %v, got = %v", ErrPrefixOrder, it.Err())
+	}
+	if kvs, _ := bt.SearchRange([]byte("b"), []byte("a")); len(kvs) != 4 {
+		t.Errorf("keys after rejected deletion: want = 4, got = %d", len(kvs))
+	}
+
+	// the Keys of the range given by the successor are only deleted and
+	// returned if they start with the prefix
+	folded := func(key1, key2 []byte) int { return bytes.Compare(bytes.ToLower(key1), bytes.ToLower(key2)) }
+	successor := func(prefix []byte) []byte { return prefixEnd(bytes.ToLower(prefix)) }
+	bt = NewBTree(NewMemDatabase(), defaultKeyLength, folded, WithPrefixSuccessor(successor))
+	for _, key := range []string{"apple", "Avocado", "avocado2", "banana"} {
+		bt.Insert([]byte(key), []byte("v"))
+	}
+	var scanned []string
+	for it := bt.ScanPrefix([]byte("a")); it.Next(); {
+		scanned = append(scanned, string(it.Key()))
+	}
+	if len(scanned) != 2 || scanned[0] != "apple" || scanned[1] != "avocado2" {
+		t.Errorf("scan prefix: want = [apple avocado2], got = %v", scanned)
+	}
+	if n, err := bt.DeletePrefix([]byte("a")); n != 2 || err != nil {
+		t.Errorf("delete prefix: want = 2, got = %d, %v", n, err)
+	}
+	for _, key := range []string{"Avocado", "banana"} {
+		if _, ok, _ := bt.Search([]byte(key)); !ok {
+			t.Errorf("search %s: want = true, got = false", key)
+		}
+	}
+
+	// a tree in the order of bytes.Compare drops the subtrees of the prefix
+	// with its successor
+	testCount := 20000
+	compare := func(key1, key2 []byte) int { return bytes.Compare(key1, key2) }
+	bt = NewBTree(NewMemDatabase(), defaultKeyLength, compare, WithPrefixSuccessor(prefixEnd))
+	for p := byte(0); p < 3; p++ {
+		for i := 0; i < testCount; i++ {
+			bt.Insert(prefixKey(p, i), []byte("v"))
+		}
+	}
+	count := 0
+	for it := bt.ScanPrefix([]byte{1}); it.Next(); count++ {
+	}
+	if count != testCount {
+		t.Errorf("scan prefix: want = %d, got = %d", testCount, count)
+	}
+	if n, err := bt.DeletePrefix([]byte{1}); n != testCount || err != nil {
+		t.Errorf("delete prefix: want = %d, got = %d, %v", testCount, n, err)
+	}
+	verifyTree(bt, 2*testCount, t)
+}
+
+func TestLoadBTree(t *testing.T) {
+	testCount := 100000
+	db := NewMemDatabase()
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare)
+
+	for i := 0; i < testCount; i++ {
+		bt.Insert(Int64ToBytes(int64(i)), []byte(fmt.Sprintf("%d", i)))
+	}
+	if err := bt.Commit(nil); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	loaded, err := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if loaded.height != bt.height || loaded.leaf != 1 || loaded.interior != bt.height-1 {
+		t.Errorf("lazily loaded: want = (1, %d, %d), got = (%d, %d, %d)",
+			bt.height-1, bt.height, loaded.leaf, loaded.interior, loaded.height)
+	}
+	resolveAll(loaded, loaded.root, t)
+	verifyTree(loaded, testCount, t)
+	if loaded.leaf != bt.leaf || loaded.interior != bt.interior || loaded.height != bt.height {
+		t.Errorf("loaded shape: want = (%d, %d, %d), got = (%d, %d, %d)",
+			bt.leaf, bt.interior, bt.height, loaded.leaf, loaded.interior, loaded.height)
+	}
+	for i := 0; i < testCount; i += 97 {
+		v, ok, _ := loaded.Search(Int64ToBytes(int64(i)))
+		if !ok || string(v) != fmt.Sprintf("%d", i) {
+			t.Errorf("search %d: got = %s, %v", i, v, ok)
+		}
+	}
+
+	if _, err := LoadBTree(db, []byte("missing"), defaultKeyLength, bytes.Compare); err == nil {
+		t.Errorf("load missing root: want error, got nil")
+	}
+}
+
+func TestWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bplustree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wal")
+
+	db := NewMemDatabase()
+	wal, err := OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare)
+	if err := bt.AttachWAL(wal); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		bt.Insert(Int64ToBytes(int64(i)), []byte("committed"))
+	}
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	root := bt.RootHash()
+
+	// updates after the commit only live in the wal
+	bt.Insert(Int64ToBytes(1), []byte("logged"))
+	bt.Insert(Int64ToBytes(1000), []byte("logged"))
+	bt.Delete(Int64ToBytes(2))
+	wal.Close()
+
+	// a torn record left by a crash during append
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+
+	wal, err = OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	recovered, err := LoadBTree(db, root, defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recovered.AttachWAL(wal); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[int64]string{0: "committed", 1: "logged", 1000: "logged"} {
+		if v, ok, _ := recovered.Search(Int64ToBytes(key)); !ok || string(v) != want {
+			t.Errorf("search %d: want = %s, got = %s", key, want, v)
+		}
+	}
+	if _, ok, _ := recovered.Search(Int64ToBytes(2)); ok {
+		t.Errorf("search deleted: want = false, got = true")
+	}
+
+	if err := recovered.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(path); info.Size() != 0 {
+		t.Errorf("wal size after commit: want = 0, got = %d", info.Size())
+	}
+}
+
+func TestTx(t *testing.T) {
+	testCount := 10000
+	db := NewMemDatabase()
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare)
+	for i := 0; i < testCount; i++ {
+		bt.Insert(Int64ToBytes(int64(i)), []byte("old"))
+	}
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	root := bt.RootHash()
+	leaf, interior, height := bt.leaf, bt.interior, bt.height
+
+	tx, _ := bt.Begin()
+	for i := testCount; i < testCount*20; i++ {
+		tx.Insert(Int64ToBytes(int64(i)), []byte("new"))
+	}
+	for i := 0; i < testCount; i += 2 {
+		tx.Delete(Int64ToBytes(int64(i)))
+	}
+	if _, ok, _ := tx.Search(Int64ToBytes(0)); ok {
+		t.Errorf("tx search deleted: want = false, got = true")
+	}
+	if v, _, _ := tx.Search(Int64ToBytes(int64(testCount))); string(v) != "new" {
+		t.Errorf("tx search inserted: want = new, got = %s", v)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err == nil {
+		t.Errorf("commit after rollback: want error, got nil")
+	}
+
+	verifyTree(bt, testCount, t)
+	if bt.leaf != leaf || bt.interior != interior || bt.height != height {
+		t.Errorf("shape after rollback: want = (%d, %d, %d), got = (%d, %d, %d)",
+			leaf, interior, height, bt.leaf, bt.interior, bt.height)
+	}
+	if bt.root.isDirty() {
+		t.Errorf("root.dirty after rollback: want = false, got = true")
+	}
+	bt.root.setDirty(true)
+	bt.Commit(nil)
+	if !bytes.Equal(bt.RootHash(), root) {
+		t.Errorf("root hash after rollback: want = %x, got = %x", root, bt.RootHash())
+	}
+
+	tx, _ = bt.Begin()
+	tx.Insert(Int64ToBytes(-1), []byte("new"))
+	tx.Delete(Int64ToBytes(0))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := bt.Search(Int64ToBytes(-1)); !ok {
+		t.Errorf("search committed insert: want = true, got = false")
+	}
+	if _, ok, _ := bt.Search(Int64ToBytes(0)); ok {
+		t.Errorf("search committed delete: want = false, got = true")
+	}
+}
+
+func TestTxConcurrent(t *testing.T) {
+	bt := NewBTree(NewMemDatabase(), defaultKeyLength, bytes.Compare, WithConcurrency())
+	bt.Insert(Int64ToBytes(0), []byte("old"))
+
+	tx, err := bt.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Insert(Int64ToBytes(0), []byte("new"))
+	if v, _, _ := tx.Search(Int64ToBytes(0)); string(v) != "new" {
+		t.Errorf("tx search: want = new, got = %s", v)
+	}
+
+	// the searches on the tree wait for the Tx, and see its updates once it
+	// is committed
+	found := make(chan []byte)
+	go func() {
+		v, _, _ := bt.Search(Int64ToBytes(0))
+		found <- v
+	}()
+	select {
+	case v := <-found:
+		t.Fatalf("search during tx: want to block, got = %s", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v := <-found; string(v) != "new" {
+		t.Errorf("search after tx: want = new, got = %s", v)
+	}
+}
+
+func TestTxWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bplustree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, err := OpenWAL(filepath.Join(dir, "wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	bt := NewBTree(NewMemDatabase(), defaultKeyLength, bytes.Compare)
+	bt.AttachWAL(wal)
+
+	tx, _ := bt.Begin()
+	tx.Insert(Int64ToBytes(1), []byte("rolled back"))
+	tx.Rollback()
+
+	tx, _ = bt.Begin()
+	tx.Insert(Int64ToBytes(2), []byte("a"))
+	tx.Insert(Int64ToBytes(3), []byte("b"))
+	tx.Delete(Int64ToBytes(2))
+	tx.Commit()
+
+	replayed := NewBTree(NewMemDatabase(), defaultKeyLength, bytes.Compare)
+	if err := replayed.AttachWAL(wal); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[int64]bool{1: false, 2: false, 3: true} {
+		if _, ok, _ := replayed.Search(Int64ToBytes(key)); ok != want {
+			t.Errorf("search %d: want = %v, got = %v", key, want, ok)
+		}
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	const (
+		writers = 8
+		perKey  = 5000
+	)
+	bt := NewBTree(newMemDB(), defaultKeyLength, bytes.Compare, WithConcurrency())
+	for i := 0; i < writers*perKey; i += 2 {
+		bt.Insert(Int64ToBytes(int64(i)), []byte("initial"))
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w * perKey; i < (w+1)*perKey; i++ {
+				key := Int64ToBytes(int64(i))
+				if i%2 == 1 {
+					bt.Insert(key, []byte("inserted"))
+				} else if i%4 == 0 {
+					bt.Delete(key)
+				}
+			}
+		}(w)
+	}
+	stop := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// keys 4k+2 are never updated
+				key := int64(4*(i%(writers*perKey/4)) + 2)
+				if v, ok, _ := bt.Search(Int64ToBytes(key)); !ok || string(v) != "initial" {
+					t.Errorf("search %d: got = %s, %v", key, v, ok)
+				}
+				kvs, _ := bt.SearchRange(Int64ToBytes(key), Int64ToBytes(key+1000))
+				for j := 1; j < len(kvs); j++ {
+					if bytes.Compare(kvs[j-1].Key, kvs[j].Key) >= 0 {
+						t.Errorf("search range: unsorted keys %x, %x", kvs[j-1].Key, kvs[j].Key)
+					}
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			if err := bt.Commit(nil); err != nil {
+				t.Errorf("commit: %v", err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	verifyTree(bt, writers*perKey*3/4, t)
+	for i := 0; i < writers*perKey; i++ {
+		_, ok, _ := bt.Search(Int64ToBytes(int64(i)))
+		if ok != (i%4 != 0) {
+			t.Errorf("search %d: want = %v, got = %v", i, i%4 != 0, ok)
+		}
+	}
+
+	// every update made between commits must reach the committed tree
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadBTree(bt.db, bt.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolveAll(loaded, loaded.root, t)
+	verifyTree(loaded, writers*perKey*3/4, t)
+}
+
+// blockingBatch blocks Write until release is closed.
+type blockingBatch struct {
+	Batch
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBatch) Write() error {
+	close(b.writing)
+	<-b.release
+	return b.Batch.Write()
+}
+
+func TestCommitConcurrentWithUpdates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bplustree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wal, err := OpenWAL(filepath.Join(dir, "wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	db := NewMemDatabase()
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare, WithConcurrency())
+	bt.AttachWAL(wal)
+	for i := 0; i < 10000; i++ {
+		bt.Insert(Int64ToBytes(int64(i)), []byte("before"))
+	}
+
+	batch := &blockingBatch{db.NewBatch(), make(chan struct{}), make(chan struct{})}
+	done := make(chan error)
+	go func() { done <- bt.Commit(batch) }()
+	<-batch.writing
+
+	// the commit is writing, searches and updates must not wait for it
+	if v, _, _ := bt.Search(Int64ToBytes(1)); string(v) != "before" {
+		t.Errorf("search during commit: want = before, got = %s", v)
+	}
+	for i := 0; i < 10000; i += 10 {
+		bt.Insert(Int64ToBytes(int64(i)), []byte("during"))
+	}
+	bt.Delete(Int64ToBytes(1))
+	if kvs, _ := bt.SearchRange(Int64ToBytes(0), Int64ToBytes(100)); len(kvs) != 100 {
+		t.Errorf("search range during commit: want = 100, got = %d", len(kvs))
+	}
+	close(batch.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := first.Search(Int64ToBytes(10)); string(v) != "before" {
+		t.Errorf("first commit: want = before, got = %s", v)
+	}
+	if _, ok, _ := first.Search(Int64ToBytes(1)); !ok {
+		t.Errorf("first commit: want key 1, got none")
+	}
+
+	// updates made during the commit are kept in the wal
+	replayed := NewBTree(NewMemDatabase(), defaultKeyLength, bytes.Compare)
+	replayed.AttachWAL(wal)
+	if v, _, _ := replayed.Search(Int64ToBytes(10)); string(v) != "during" {
+		t.Errorf("wal after commit: want = during, got = %s", v)
+	}
+
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolveAll(second, second.root, t)
+	verifyTree(second, 9999, t)
+	if v, _, _ := second.Search(Int64ToBytes(10)); string(v) != "during" {
+		t.Errorf("second commit: want = during, got = %s", v)
+	}
+}
+
+func TestNodeCache(t *testing.T) {
+	testCount := 100000
+	db := NewMemDatabase()
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare)
+	for i := 0; i < testCount; i++ {
+		bt.Insert(Int64ToBytes(int64(i)), []byte(fmt.Sprintf("%d", i)))
+	}
+	bt.Commit(nil)
+
+	cache := NewNodeCache(1 << 30)
+	for round := 0; round < 2; round++ {
+		loaded, err := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare, WithNodeCache(cache))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < testCount; i += 1000 {
+			if v, ok, _ := loaded.Search(Int64ToBytes(int64(i))); !ok || string(v) != fmt.Sprintf("%d", i) {
+				t.Errorf("search %d: got = %s, %v", i, v, ok)
+			}
+		}
+		// updates of a tree don't leak into the cache shared with the others
+		loaded.Insert(Int64ToBytes(0), []byte("updated"))
+	}
+
+	stats := cache.Stats()
+	if stats.Misses == 0 || stats.Hits != stats.Misses {
+		t.Errorf("cache stats: want hits = misses > 0, got = %+v", stats)
+	}
+
+	loaded, _ := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare, WithNodeCache(cache))
+	if v, _, _ := loaded.Search(Int64ToBytes(0)); string(v) != "0" {
+		t.Errorf("search from cache: want = 0, got = %s", v)
+	}
+
+	// the cache is bounded by the encoded size of the nodes
+	small := NewNodeCache(64 * 1024)
+	loaded, _ = LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare, WithNodeCache(small))
+	resolveAll(loaded, loaded.root, t)
+	if stats := small.Stats(); stats.Size > 64*1024 || stats.Evictions == 0 {
+		t.Errorf("small cache stats: %+v", stats)
+	}
+}
+
+func TestConcurrentLoad(t *testing.T) {
+	testCount := 100000
+	db := NewMemDatabase()
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare)
+	for i := 0; i < testCount; i++ {
+		bt.Insert(Int64ToBytes(int64(i)), []byte("v"))
+	}
+	bt.Commit(nil)
+
+	loaded, err := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare,
+		WithConcurrency(), WithNodeCache(NewNodeCache(1<<20)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < testCount; i += 8 {
+				key := Int64ToBytes(int64(i))
+				if _, ok, _ := loaded.Search(key); !ok {
+					t.Errorf("search %d: want = true, got = false", i)
+				}
+				if i%3 == 0 {
+					loaded.Insert(key, []byte("updated"))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	loaded.Commit(nil)
+	check, _ := LoadBTree(db, loaded.RootHash(), defaultKeyLength, bytes.Compare)
+	resolveAll(check, check.root, t)
+	verifyTree(check, testCount, t)
+	if v, _, _ := check.Search(Int64ToBytes(3)); string(v) != "updated" {
+		t.Errorf("search 3: want = updated, got = %s", v)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	testCount := 100000
+	limit := 256 * 1024
+	db := NewMemDatabase()
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare, WithMemoryLimit(limit))
+	for i := 0; i < testCount; i++ {
+		bt.Insert(Int64ToBytes(int64(i)), []byte(fmt.Sprintf("%d", i)))
+	}
+	// dirty nodes are kept until they are committed
+	leaves := bt.leaf
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	if bt.leaf >= leaves || bt.measure(bt.root, nil) > int64(limit) {
+		t.Errorf("commit: want trimmed tree, got %d of %d leaves", bt.leaf, leaves)
+	}
+
+	for i := 0; i < testCount; i++ {
+		if v, ok, _ := bt.Search(Int64ToBytes(int64(i))); !ok || string(v) != fmt.Sprintf("%d", i) {
+			t.Fatalf("search %d: got = %s, %v", i, v, ok)
+		}
+		if size := atomic.LoadInt64(&bt.loaded); size > int64(limit) {
+			t.Fatalf("search %d: loaded %d bytes over the limit", i, size)
+		}
+	}
+	if kvs, _ := bt.SearchRange(Int64ToBytes(0), Int64ToBytes(int64(testCount))); len(kvs) != testCount {
+		t.Errorf("search range: want = %d, got = %d", testCount, len(kvs))
+	}
+
+	// unloaded subtrees are loaded again for updates and the next commit
+	for i := 0; i < testCount; i += 7 {
+		bt.Insert(Int64ToBytes(int64(i)), []byte("updated"))
+	}
+	if ok, _ := bt.Delete(Int64ToBytes(1)); !ok {
+		t.Errorf("delete: want = true, got = false")
+	}
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolveAll(loaded, loaded.root, t)
+	verifyTree(loaded, testCount-1, t)
+	for i := 0; i < testCount; i += 7 {
+		if v, _, _ := loaded.Search(Int64ToBytes(int64(i))); string(v) != "updated" {
+			t.Errorf("search %d: want = updated, got = %s", i, v)
+		}
+	}
+}
+
+func TestMemoryLimitConcurrent(t *testing.T) {
+	testCount, limit := 50000, 64*1024
+	db := NewMemDatabase()
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare, WithConcurrency(), WithMemoryLimit(limit))
+	for i := 0; i < testCount; i++ {
+		bt.Insert(Int64ToBytes(int64(i)), []byte("v"))
+	}
+	bt.Commit(nil)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < testCount; i += 4 {
+				key := Int64ToBytes(int64(i))
+				if _, ok, _ := bt.Search(key); !ok {
+					t.Errorf("search %d: want = true, got = false", i)
+				}
+				if i%5 == 0 {
+					bt.Insert(key, []byte("updated"))
+				}
+				if i%5000 == 0 {
+					bt.Commit(nil)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, _ := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare)
+	for i := 0; i < testCount; i += 5 {
+		if v, _, _ := loaded.Search(Int64ToBytes(int64(i))); string(v) != "updated" {
+			t.Errorf("search %d: want = updated, got = %s", i, v)
+		}
+	}
+
+	// the nodes loaded by concurrent reads count towards the limit
+	loaded, _ = LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare, WithConcurrency(), WithMemoryLimit(limit))
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 7 * w; i < testCount; i += 28 {
+				if _, ok, _ := loaded.Search(Int64ToBytes(int64(i))); !ok {
+					t.Errorf("search %d: want = true, got = false", i)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	held := heldSize(loaded.root)
+	if held > int64(2*limit) {
+		t.Errorf("concurrent reads: %d bytes held over the limit", held)
+	}
+	if size := atomic.LoadInt64(&loaded.loaded); size < held*3/4 {
+		t.Errorf("concurrent reads: %d bytes held, %d counted", held, size)
+	}
+}
+
+// heldSize returns the encoded size of all the nodes held in the subtree of n,
+// the ones parked in their placeholders included.
+func heldSize(n Node) int64 {
+	switch node := n.(type) {
+	case *HashNode:
+		if node.node == nil {
+			return 0
+		}
+		return heldSize(node.node)
+	case *InteriorNode:
+		size := nodeSize(node)
+		for i := 0; i < node.Count; i++ {
+			size += heldSize(node.Kcs.data[i].Child)
+		}
+		return size
+	default:
+		return nodeSize(n)
+	}
+}
+
+// failingBatch fails to write.
+type failingBatch struct {
+	Batch
+}
+
+func (b *failingBatch) Write() error {
+	return errors.New("write failed")
+}
+
+func TestErrors(t *testing.T) {
+	testCount := 10000
+	db := NewMemDatabase()
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare)
+	for i := 0; i < testCount; i++ {
+		if err := bt.Insert(Int64ToBytes(int64(i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	long := make([]byte, defaultKeyLength+1)
+	if err := bt.Insert(long, nil); err != ErrKeyTooLong {
+		t.Errorf("insert long key: want = %v, got = %v", ErrKeyTooLong, err)
+	}
+	if _, _, err := bt.Search(long); err != ErrKeyTooLong {
+		t.Errorf("search long key: want = %v, got = %v", ErrKeyTooLong, err)
+	}
+	if _, err := bt.Delete(long); err != ErrKeyTooLong {
+		t.Errorf("delete long key: want = %v, got = %v", ErrKeyTooLong, err)
+	}
+
+	// a commit which fails to write leaves the tree to the next commit
+	if err := bt.Commit(&failingBatch{db.NewBatch()}); err == nil {
+		t.Errorf("commit: want error, got = nil")
+	}
+	if db.Len() != 0 || bt.RootHash() != nil {
+		t.Errorf("failed commit: want nothing written, got %d nodes", db.Len())
+	}
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// remove the last leaf from the db, and corrupt the one before
+	last := bt.root.Kcs.data[bt.root.Count-1].Child
+	_, lastHash, _ := last.cache()
+	_, prevHash, _ := bt.root.Kcs.data[bt.root.Count-2].Child.cache()
+	db.Delete(lastHash)
+	db.Put(prevHash, []byte{prefixLeaf, 1, 2, 3})
+
+	loaded, err := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastKey := Int64ToBytes(int64(testCount - 1))
+	_, _, err = loaded.Search(lastKey)
+	var nodeErr *NodeError
+	if !errors.Is(err, ErrMissingNode) || !errors.As(err, &nodeErr) || !bytes.Equal(nodeErr.Hash, lastHash) {
+		t.Errorf("search missing node: want = %v, got = %v", ErrMissingNode, err)
+	}
+	if err := loaded.Insert(lastKey, []byte("updated")); !errors.Is(err, ErrMissingNode) {
+		t.Errorf("insert into missing node: want = %v, got = %v", ErrMissingNode, err)
+	}
+	if _, err := loaded.Delete(lastKey); !errors.Is(err, ErrMissingNode) {
+		t.Errorf("delete from missing node: want = %v, got = %v", ErrMissingNode, err)
+	}
+	if _, err := loaded.SearchRange(Int64ToBytes(0), lastKey); !errors.Is(err, ErrCorruptNode) {
+		t.Errorf("search range over corrupt node: want = %v, got = %v", ErrCorruptNode, err)
+	}
+
+	// the rest of the tree is still usable
+	if v, ok, err := loaded.Search(Int64ToBytes(0)); err != nil || !ok || string(v) != "v" {
+		t.Errorf("search: got = %s, %v, %v", v, ok, err)
+	}
+
+	if _, err := LoadBTree(db, lastHash, defaultKeyLength, bytes.Compare); !errors.Is(err, ErrMissingNode) {
+		t.Errorf("load missing root: want = %v, got = %v", ErrMissingNode, err)
+	}
+	if _, err := LoadBTree(db, prevHash, defaultKeyLength, bytes.Compare); !errors.Is(err, ErrCorruptNode) {
+		t.Errorf("load corrupt root: want = %v, got = %v", ErrCorruptNode, err)
+	}
+
+	tx, err := bt.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bt.Begin(); err != ErrTxInProgress {
+		t.Errorf("begin: want = %v, got = %v", ErrTxInProgress, err)
+	}
+	tx.Commit()
+	if err := tx.Insert(Int64ToBytes(0), nil); err != ErrTxDone {
+		t.Errorf("insert after commit: want = %v, got = %v", ErrTxDone, err)
+	}
+
+	if key := newLeafNode(nil, defaultKeyLength, bytes.Compare).largestKey(); key != nil {
+		t.Errorf("largest key of empty leaf: want = nil, got = %v", key)
+	}
+}
+
+func TestIterator(t *testing.T) {
+	testCount := 10000
+	bt := NewBTree(NewMemDatabase(), defaultKeyLength, bytes.Compare)
+	for i := 0; i < testCount; i++ {
+		bt.Insert(Int64ToBytes(int64(i)), []byte(fmt.Sprintf("%d", i)))
+	}
+
+	it := bt.Iterate(Int64ToBytes(100), Int64ToBytes(5000))
+	for i := 100; i <= 5000; i++ {
+		if !it.Next() {
+			t.Fatalf("next %d: want = true, got = false", i)
+		}
+		if BytesToInt64(it.Key()) != int64(i) || string(it.Value()) != fmt.Sprintf("%d", i) {
+			t.Fatalf("next %d: got = %d, %s", i, BytesToInt64(it.Key()), it.Value())
+		}
+		// updates behind and ahead of the iterator
+		if i%100 == 0 {
+			bt.Delete(Int64ToBytes(int64(i - 50)))
+			bt.Insert(Int64ToBytes(int64(i+1)), []byte("updated"))
+		}
+	}
+	if it.Next() || it.Err() != nil {
+		t.Errorf("next past end: got = true, %v", it.Err())
+	}
+
+	count := 0
+	for it = bt.Iterate(nil, nil); it.Next(); count++ {
+	}
+	if count != testCount-50 {
+		t.Errorf("iterate all: want = %d, got = %d", testCount-50, count)
+	}
+}
+
+func TestTypedTree(t *testing.T) {
+	bt := NewBTree(NewMemDatabase(), 8, bytes.Compare)
+	tree := NewTypedTree[int64, string](bt, Int64Codec{}, StringCodec{})
+	for i := -1000; i < 1000; i++ {
+		if err := tree.Insert(int64(i), fmt.Sprintf("%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, ok, err := tree.Get(-5); err != nil || !ok || v != "-5" {
+		t.Errorf("get: got = %s, %v, %v", v, ok, err)
+	}
+	if _, ok, _ := tree.Get(1000); ok {
+		t.Errorf("get missing: want = false, got = true")
+	}
+
+	// negative Keys sort before positive ones
+	kvs, err := tree.Range(-10, 10)
+	if err != nil || len(kvs) != 21 {
+		t.Fatalf("range: want = 21, got = %d, %v", len(kvs), err)
+	}
+	for i, kv := range kvs {
+		if kv.Key != int64(i-10) || kv.Value != fmt.Sprintf("%d", i-10) {
+			t.Errorf("range %d: got = %d, %s", i, kv.Key, kv.Value)
+		}
+	}
+
+	want := int64(-1000)
+	for it := tree.All(); it.Next(); want++ {
+		if it.Key() != want {
+			t.Fatalf("all: want = %d, got = %d", want, it.Key())
+		}
+	}
+	if want != 1000 {
+		t.Errorf("all: want = 2000 KVs, got = %d", want+1000)
+	}
+
+	names := NewTypedTree[string, [32]byte](NewBTree(NewMemDatabase(), 16, bytes.Compare), StringCodec{}, Bytes32Codec{})
+	for _, name := range []string{"carol", "alice", "bob"} {
+		names.Insert(name, sha3.Sum256([]byte(name)))
+	}
+	if err := names.Insert("a name too long for the tree", [32]byte{}); err != ErrKeyTooLong {
+		t.Errorf("insert long key: want = %v, got = %v", ErrKeyTooLong, err)
+	}
+	var got []string
+	for it := names.Iterate("alice", "bob"); it.Next(); {
+		if it.Value() != sha3.Sum256([]byte(it.Key())) {
+			t.Errorf("iterate %s: wrong value", it.Key())
+		}
+		got = append(got, it.Key())
+	}
+	if fmt.Sprint(got) != "[alice bob]" {
+		t.Errorf("iterate: want = [alice bob], got = %v", got)
+	}
+}
+
+// verifyRanks checks the order statistics of a tree holding the Keys from 0
+// to count - 1 in steps of step.
+func verifyRanks(bt *BTree, count, step int, t *testing.T) {
+	if n, _ := bt.Len(); n != count {
+		t.Fatalf("len: want = %d, got = %d", count, n)
+	}
+	for i := 0; i < count; i += 97 {
+		key := int64(i * step)
+		if rank, err := bt.Rank(Int64ToBytes(key)); err != nil || rank != i {
+			t.Errorf("rank %d: want = %d, got = %d, %v", key, i, rank, err)
+		}
+		if step > 1 {
+			if rank, _ := bt.Rank(Int64ToBytes(key + 1)); rank != i+1 {
+				t.Errorf("rank %d: want = %d, got = %d", key+1, i+1, rank)
+			}
+		}
+		kv, err := bt.Select(i)
+		if err != nil || BytesToInt64(kv.Key) != key {
+			t.Errorf("select %d: want = %d, got = %d, %v", i, key, BytesToInt64(kv.Key), err)
+		}
+	}
+	if _, err := bt.Select(count); err != ErrOutOfRange {
+		t.Errorf("select %d: want = %v, got = %v", count, ErrOutOfRange, err)
+	}
+	if n, _ := bt.CountRange(Int64ToBytes(int64(step)), Int64ToBytes(int64(10*step))); n != 10 {
+		t.Errorf("count range: want = 10, got = %d", n)
+	}
+	if n, _ := bt.CountRange(Int64ToBytes(int64(step+1)), Int64ToBytes(int64(10*step-1))); step > 1 && n != 8 {
+		t.Errorf("count range between keys: want = 8, got = %d", n)
+	}
+	if n, _ := bt.CountRange(Int64ToBytes(10), Int64ToBytes(0)); n != 0 {
+		t.Errorf("count empty range: want = 0, got = %d", n)
+	}
+}
+
+func TestRank(t *testing.T) {
+	testCount := 100000
+	db := NewMemDatabase()
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare)
+	for i := testCount - 1; i >= 0; i-- {
+		bt.Insert(Int64ToBytes(int64(i*2)), nil)
+	}
+	verifyRanks(bt, testCount, 2, t)
+
+	// the Sizes are kept up to date by updates between queries
+	for i := testCount / 2; i < testCount; i++ {
+		bt.Delete(Int64ToBytes(int64(i * 2)))
+	}
+	verifyRanks(bt, testCount/2, 2, t)
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the Sizes are committed, a loaded tree only loads the nodes on the
+	// path to the Key
+	loaded, err := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := loaded.Len(); n != testCount/2 {
+		t.Errorf("loaded len: want = %d, got = %d", testCount/2, n)
+	}
+	if kv, _ := loaded.Select(testCount/2 - 1); BytesToInt64(kv.Key) != int64(testCount-2) {
+		t.Errorf("loaded select last: got = %d", BytesToInt64(kv.Key))
+	}
+	if loaded.leaf != 2 {
+		t.Errorf("loaded leaves: want = 2, got = %d", loaded.leaf)
+	}
+	verifyRanks(loaded, testCount/2, 2, t)
+
+	tx, _ := loaded.Begin()
+	for i := 0; i < 1000; i++ {
+		tx.Insert(Int64ToBytes(int64(i*2+1)), nil)
+	}
+	if n, _ := loaded.Len(); n != testCount/2+1000 {
+		t.Errorf("len in tx: want = %d, got = %d", testCount/2+1000, n)
+	}
+	tx.Rollback()
+	verifyRanks(loaded, testCount/2, 2, t)
+
+	// a rollback restores the Sizes of the nodes modified since the last
+	// commit, which are committed afterwards
+	bt = NewBTree(NewMemDatabase(), defaultKeyLength, bytes.Compare)
+	for i := 0; i < 2000; i++ {
+		bt.Insert(Int64ToBytes(int64(i)), nil)
+	}
+	tx, _ = bt.Begin()
+	for i := 2000; i < 2100; i++ {
+		tx.Insert(Int64ToBytes(int64(i)), nil)
+	}
+	if n, _ := bt.Len(); n != 2100 {
+		t.Errorf("len in tx: want = 2100, got = %d", n)
+	}
+	tx.Rollback()
+	verifyRanks(bt, 2000, 1, t)
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = LoadBTree(bt.db, bt.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyRanks(loaded, 2000, 1, t)
+}
+
+func TestRankConcurrent(t *testing.T) {
+	testCount := 20000
+	bt := NewBTree(NewMemDatabase(), defaultKeyLength, bytes.Compare, WithConcurrency())
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < testCount; i += 4 {
+				bt.Insert(Int64ToBytes(int64(i)), nil)
+				if i%1000 == 0 {
+					bt.Len()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	verifyRanks(bt, testCount, 1, t)
+
+	for i := 0; i < testCount; i += 2 {
+		bt.Delete(Int64ToBytes(int64(i)))
+	}
+	if n, _ := bt.Len(); n != testCount/2 {
+		t.Errorf("len: want = %d, got = %d", testCount/2, n)
+	}
+}
+
+func TestAggregateRange(t *testing.T) {
+	testCount := 50000
+	value := func(v []byte) int64 { return BytesToInt64(v) }
+	sum := SumAggregator(value)
+	db := NewMemDatabase()
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare, WithAggregator(sum))
+	for i := testCount - 1; i >= 0; i-- {
+		bt.Insert(Int64ToBytes(int64(i)), Int64ToBytes(int64(i)))
+	}
+
+	// sum of the Values from a to b
+	want := func(a, b int64) int64 { return (a + b) * (b - a + 1) / 2 }
+	verify := func(bt *BTree, a, b int64) {
+		agg, err := bt.AggregateRange(Int64ToBytes(a), Int64ToBytes(b))
+		if err != nil || BytesToInt64(agg) != want(a, b) {
+			t.Errorf("aggregate [%d, %d]: want = %d, got = %d, %v", a, b, want(a, b), BytesToInt64(agg), err)
+		}
+	}
+	verify(bt, 0, int64(testCount-1))
+	verify(bt, 100, 40000)
+	verify(bt, 7, 7)
+	if agg, _ := bt.AggregateRange(Int64ToBytes(10), Int64ToBytes(5)); agg != nil {
+		t.Errorf("aggregate empty range: want = nil, got = %x", agg)
+	}
+
+	// the aggregates follow updates
+	for i := 0; i < testCount; i += 10 {
+		bt.Insert(Int64ToBytes(int64(i)), Int64ToBytes(int64(2*i)))
+	}
+	for i := 5; i < testCount; i += 10 {
+		bt.Delete(Int64ToBytes(int64(i)))
+	}
+	// Values from 0 to 999 are now the sum minus the deleted plus the doubled
+	expect := want(0, 999) - (5+995)*100/2 + (0+990)*100/2
+	if agg, _ := bt.AggregateRange(Int64ToBytes(0), Int64ToBytes(999)); BytesToInt64(agg) != expect {
+		t.Errorf("aggregate after updates: want = %d, got = %d", expect, BytesToInt64(agg))
+	}
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// proofs of the committed aggregates
+	agg, proof, err := bt.ProveAggregateRange(Int64ToBytes(0), Int64ToBytes(999))
+	if err != nil || BytesToInt64(agg) != expect {
+		t.Fatalf("prove: want = %d, got = %d, %v", expect, BytesToInt64(agg), err)
+	}
+	if len(proof.Nodes) > 2*bt.height-1 {
+		t.Errorf("proof: want nodes on the bound paths only, got %d nodes", len(proof.Nodes))
+	}
+	if _, single, _ := bt.ProveAggregateRange(Int64ToBytes(30000), Int64ToBytes(30000)); len(single.Nodes) != bt.height {
+		t.Errorf("proof of a single Key: want = %d nodes, got = %d", bt.height, len(single.Nodes))
+	}
+	root := bt.RootHash()
+	if err := VerifyAggregateRange(root, Int64ToBytes(0), Int64ToBytes(999), agg, proof, defaultKeyLength, bytes.Compare, sum); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+	if err := VerifyAggregateRange(root, Int64ToBytes(0), Int64ToBytes(999), Int64ToBytes(1), proof, defaultKeyLength, bytes.Compare, sum); err != ErrInvalidProof {
+		t.Errorf("verify wrong aggregate: want = %v, got = %v", ErrInvalidProof, err)
+	}
+	if err := VerifyAggregateRange(root, Int64ToBytes(0), Int64ToBytes(30000), agg, proof, defaultKeyLength, bytes.Compare, sum); err != ErrInvalidProof {
+		t.Errorf("verify other range: want = %v, got = %v", ErrInvalidProof, err)
+	}
+
+	// aggregates are committed and loaded with the nodes
+	max := MaxAggregator(value)
+	loaded, _ := LoadBTree(db, root, defaultKeyLength, bytes.Compare, WithAggregator(sum))
+	if agg, _ := loaded.AggregateRange(Int64ToBytes(0), Int64ToBytes(999)); BytesToInt64(agg) != expect {
+		t.Errorf("loaded aggregate: want = %d, got = %d", expect, BytesToInt64(agg))
+	}
+	bt = NewBTree(NewMemDatabase(), defaultKeyLength, bytes.Compare, WithAggregator(max))
+	for i := 0; i < testCount; i++ {
+		bt.Insert(Int64ToBytes(int64(i)), Int64ToBytes(int64(i%1000)))
+	}
+	if agg, _ := bt.AggregateRange(Int64ToBytes(10), Int64ToBytes(500)); BytesToInt64(agg) != 500 {
+		t.Errorf("max: want = 500, got = %d", BytesToInt64(agg))
+	}
+	tx, _ := bt.Begin()
+	tx.Insert(Int64ToBytes(20), Int64ToBytes(5000))
+	if agg, _ := bt.AggregateRange(Int64ToBytes(10), Int64ToBytes(500)); BytesToInt64(agg) != 5000 {
+		t.Errorf("max in tx: want = 5000, got = %d", BytesToInt64(agg))
+	}
+	tx.Rollback()
+	if agg, _ := bt.AggregateRange(Int64ToBytes(10), Int64ToBytes(500)); BytesToInt64(agg) != 500 {
+		t.Errorf("max after rollback: want = 500, got = %d", BytesToInt64(agg))
+	}
+	if _, err := NewBTree(db, defaultKeyLength, bytes.Compare).AggregateRange(nil, nil); err != ErrNoAggregator {
+		t.Errorf("aggregate without aggregator: want = %v, got = %v", ErrNoAggregator, err)
+	}
+}
+
+// verifyNeighbors checks the neighbour lookups of a tree holding the even
+// Keys from 0 to 2 * (count - 1).
+func verifyNeighbors(bt *BTree, count int, t *testing.T) {
+	check := func(name string, kv KV, ok bool, err error, want int64) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if want < 0 {
+			if ok {
+				t.Errorf("%s: want none, got = %d", name, BytesToInt64(kv.Key))
+			}
+			return
+		}
+		if !ok || BytesToInt64(kv.Key) != want {
+			t.Errorf("%s: want = %d, got = %d, %v", name, want, BytesToInt64(kv.Key), ok)
+		}
+	}
+	last := int64(2 * (count - 1))
+	kv, ok, err := bt.Min()
+	check("min", kv, ok, err, 0)
+	kv, ok, err = bt.Max()
+	check("max", kv, ok, err, last)
+
+	for i := int64(-1); i <= last+1; i++ {
+		key := Int64ToBytes(i)
+		even := i%2 == 0
+
+		floor, lower, ceiling, higher := i-1, i-2, i+1, i+2
+		if even {
+			floor, ceiling = i, i
+		} else {
+			lower = i - 1
+			higher = i + 1
+		}
+		// Int64ToBytes doesn't sort -1 first
+		if i < 0 {
+			floor, lower, ceiling, higher = last, last, -1, -1
+		}
+		if floor < 0 {
+			floor = -1
+		}
+		if lower < 0 {
+			lower = -1
+		}
+		if ceiling > last {
+			ceiling = -1
+		}
+		if higher > last {
+			higher = -1
+		}
+		kv, ok, err = bt.Floor(key)
+		check(fmt.Sprintf("floor %d", i), kv, ok, err, floor)
+		kv, ok, err = bt.Lower(key)
+		check(fmt.Sprintf("lower %d", i), kv, ok, err, lower)
+		kv, ok, err = bt.Ceiling(key)
+		check(fmt.Sprintf("ceiling %d", i), kv, ok, err, ceiling)
+		kv, ok, err = bt.Higher(key)
+		check(fmt.Sprintf("higher %d", i), kv, ok, err, higher)
+	}
+}
+
+func TestNeighbors(t *testing.T) {
+	testCount := 5000
+	db := NewMemDatabase()
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare)
+	if _, ok, _ := bt.Min(); ok {
+		t.Errorf("min of empty tree: want = false, got = true")
+	}
+	if _, ok, _ := bt.Floor(Int64ToBytes(5)); ok {
+		t.Errorf("floor in empty tree: want = false, got = true")
+	}
+	for i := testCount - 1; i >= 0; i-- {
+		bt.Insert(Int64ToBytes(int64(2*i)), nil)
+	}
+	verifyNeighbors(bt, testCount, t)
+	verifyTree(bt, testCount, t)
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the neighbour leaves of a lazily loaded tree are found from the root
+	loaded, _ := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare)
+	verifyNeighbors(loaded, testCount, t)
+
+	concurrent, _ := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare, WithConcurrency())
+	verifyNeighbors(concurrent, testCount, t)
+
+	// the chaining of the leaves survives merges and rollbacks
+	tx, _ := bt.Begin()
+	for i := 0; i < testCount; i++ {
+		tx.Insert(Int64ToBytes(int64(2*i+1)), nil)
+	}
+	tx.Rollback()
+	for i := testCount / 2; i < testCount; i++ {
+		bt.Delete(Int64ToBytes(int64(2 * i)))
+	}
+	verifyNeighbors(bt, testCount/2, t)
+	verifyTree(bt, testCount/2, t)
+}
+
+// readPages reads all the pages of a range query, calling between after each
+// page.
+func readPages(bt *BTree, kvs []KV, cursor []byte, err error, limit int, between func(), t *testing.T) []int64 {
+	var keys []int64
+	for {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(kvs) > limit {
+			t.Fatalf("page: want <= %d KVs, got = %d", limit, len(kvs))
+		}
+		for _, kv := range kvs {
+			keys = append(keys, BytesToInt64(kv.Key))
+		}
+		if cursor == nil {
+			return keys
+		}
+		between()
+		kvs, cursor, err = bt.NextPage(cursor, limit)
+	}
+}
+
+func TestSearchRangePage(t *testing.T) {
+	testCount := 10000
+	bt := NewBTree(NewMemDatabase(), defaultKeyLength, bytes.Compare)
+	for i := 0; i < testCount; i++ {
+		bt.Insert(Int64ToBytes(int64(2*i)), []byte("v"))
+	}
+
+	// forward pages see the KVs inserted ahead of the cursor, and never skip
+	// or repeat a KV
+	next := int64(1)
+	kvs, cursor, err := bt.SearchRangePage(Int64ToBytes(100), Int64ToBytes(3000), 100, false)
+	keys := readPages(bt, kvs, cursor, err, 100, func() {
+		bt.Insert(Int64ToBytes(next), nil)
+		bt.Insert(Int64ToBytes(next+2000), nil)
+		next += 2
+	}, t)
+	for i := 1; i < len(keys); i++ {
+		if keys[i] <= keys[i-1] {
+			t.Fatalf("forward pages: %d after %d", keys[i], keys[i-1])
+		}
+	}
+	if keys[0] != 100 || keys[len(keys)-1] != 3000 || len(keys) <= 1451 {
+		t.Errorf("forward pages: got %d keys from %d to %d", len(keys), keys[0], keys[len(keys)-1])
+	}
+
+	// reverse pages over the whole tree
+	kvs, cursor, err = bt.SearchRangePage(nil, nil, 333, true)
+	keys = readPages(bt, kvs, cursor, err, 333, func() {}, t)
+	if n, _ := bt.Len(); len(keys) != n {
+		t.Errorf("reverse pages: want = %d, got = %d", n, len(keys))
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i] >= keys[i-1] {
+			t.Fatalf("reverse pages: %d after %d", keys[i], keys[i-1])
+		}
+	}
+	if kvs, cursor, _ := bt.SearchRangePage(Int64ToBytes(10), Int64ToBytes(20), 0, true); len(kvs) != 11 || cursor != nil {
+		t.Errorf("unlimited page: want = 11 KVs, got = %d, %x", len(kvs), cursor)
+	}
+
+	// pages bound to a committed root ignore the following commits
+	if _, _, err := bt.SearchCommittedRangePage(nil, nil, 10, false); err != ErrNotCommitted {
+		t.Errorf("committed page: want = %v, got = %v", ErrNotCommitted, err)
+	}
+	bt.Commit(nil)
+	count, _ := bt.Len()
+	kvs, cursor, err = bt.SearchCommittedRangePage(nil, nil, 1000, false)
+	keys = readPages(bt, kvs, cursor, err, 1000, func() {
+		bt.Delete(Int64ToBytes(next))
+		next -= 2
+		bt.Commit(nil)
+	}, t)
+	if len(keys) != count {
+		t.Errorf("committed pages: want = %d, got = %d", count, len(keys))
+	}
+
+	if _, _, err := bt.NextPage([]byte("cursor"), 10); err != ErrInvalidCursor {
+		t.Errorf("invalid cursor: want = %v, got = %v", ErrInvalidCursor, err)
+	}
+}
+
+func prefixKey(prefix byte, i int) []byte {
+	return append([]byte{prefix}, Int64ToBytes(int64(i))[1:]...)
+}
+
+func TestPrefix(t *testing.T) {
+	testCount := 20000
+	db := NewMemDatabase()
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare)
+	for p := byte(0); p < 5; p++ {
+		for i := 0; i < testCount; i++ {
+			bt.Insert(prefixKey(p, i), []byte("v"))
+		}
+	}
+	bt.Insert([]byte{2}, []byte("prefix"))
+
+	i := -1
+	for it := bt.ScanPrefix([]byte{2}); it.Next(); i++ {
+		want := []byte{2}
+		if i >= 0 {
+			want = prefixKey(2, i)
+		}
+		if !bytes.Equal(it.Key(), want) {
+			t.Fatalf("scan prefix %d: want = %x, got = %x", i, want, it.Key())
+		}
+	}
+	if i != testCount {
+		t.Errorf("scan prefix: want = %d, got = %d", testCount, i)
+	}
+
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	root := bt.RootHash()
+
+	// a rolled back deletion leaves the tree as it was
+	tx, _ := bt.Begin()
+	if n, err := tx.DeletePrefix([]byte{0}); n != testCount || err != nil {
+		t.Errorf("tx delete prefix: want = %d, got = %d, %v", testCount, n, err)
+	}
+	tx.Rollback()
+	verifyTree(bt, 5*testCount+1, t)
+	bt.root.setDirty(true)
+	bt.Commit(nil)
+	if !bytes.Equal(bt.RootHash(), root) {
+		t.Errorf("root hash after rollback: want = %x, got = %x", root, bt.RootHash())
+	}
+
+	if n, err := bt.DeletePrefix(prefixKey(1, 1000)[:7]); n != 256 || err != nil {
+		t.Errorf("delete prefix in a leaf: want = 256, got = %d, %v", n, err)
+	}
+	if n, err := bt.DeletePrefix([]byte{2}); n != testCount+1 || err != nil {
+		t.Errorf("delete prefix: want = %d, got = %d, %v", testCount+1, n, err)
+	}
+	if n, _ := bt.DeletePrefix([]byte{2}); n != 0 {
+		t.Errorf("delete prefix again: want = 0, got = %d", n)
+	}
+	verifyTree(bt, 4*testCount-256, t)
+	if n, _ := bt.Len(); n != 4*testCount-256 {
+		t.Errorf("len: want = %d, got = %d", 4*testCount-256, n)
+	}
+	for _, key := range [][]byte{prefixKey(1, 767), prefixKey(1, 1024), prefixKey(3, 0)} {
+		if _, ok, _ := bt.Search(key); !ok {
+			t.Errorf("search %x: want = true, got = false", key)
+		}
+	}
+	if it := bt.ScanPrefix([]byte{2}); it.Next() {
+		t.Errorf("scan deleted prefix: got = %x", it.Key())
+	}
+
+	// the subtrees inside the prefix are dropped without being loaded
+	loaded, err := LoadBTree(db, root, defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := loaded.DeletePrefix([]byte{3}); n != testCount || err != nil {
+		t.Errorf("delete prefix of loaded tree: want = %d, got = %d, %v", testCount, n, err)
+	}
+	if loaded.leaf > 8 {
+		t.Errorf("loaded leaves: want <= 8, got = %d", loaded.leaf)
+	}
+	if err := loaded.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ = LoadBTree(db, loaded.RootHash(), defaultKeyLength, bytes.Compare)
+	if n, _ := loaded.Len(); n != 4*testCount+1 {
+		t.Errorf("len after reload: want = %d, got = %d", 4*testCount+1, n)
+	}
+
+	if n, _ := bt.DeletePrefix(nil); n != 4*testCount-256 {
+		t.Errorf("delete all: want = %d, got = %d", 4*testCount-256, n)
+	}
+	if bt.height != 2 || bt.leaf != 1 || bt.first.Count != 0 {
+		t.Errorf("empty tree: height = %d, leaf = %d, count = %d", bt.height, bt.leaf, bt.first.Count)
+	}
+}
+
+func TestPrefixWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bplustree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, err := OpenWAL(filepath.Join(dir, "wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	bt := NewBTree(NewMemDatabase(), defaultKeyLength, bytes.Compare)
+	bt.AttachWAL(wal)
+	for i := 0; i < 1000; i++ {
+		bt.Insert(prefixKey(byte(i%2), i), []byte("v"))
+	}
+	bt.DeletePrefix([]byte{0})
+
+	replayed := NewBTree(NewMemDatabase(), defaultKeyLength, bytes.Compare)
+	if err := replayed.AttachWAL(wal); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := replayed.Len(); n != 500 {
+		t.Errorf("len: want = 500, got = %d", n)
+	}
+	if _, ok, _ := replayed.Search(prefixKey(1, 1)); !ok {
+		t.Errorf("search kept key: want = true, got = false")
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	testCount := 100000
+	for _, opts := range [][]Option{nil, {WithConcurrency()}} {
+		db := NewMemDatabase()
+		bt := NewBTree(db, defaultKeyLength, bytes.Compare, opts...)
+		for i := 0; i < testCount; i++ {
+			bt.Insert(Int64ToBytes(int64(i)), []byte("v"))
+		}
+		if err := bt.Commit(nil); err != nil {
+			t.Fatal(err)
+		}
+		root := bt.RootHash()
+
+		keys := make(map[int]bool, testCount)
+		for i := 0; i < testCount; i++ {
+			keys[i] = true
+		}
+		drop := func(start, end int) int {
+			n := 0
+			for i := start; i <= end; i++ {
+				if keys[i] {
+					n++
+					delete(keys, i)
+				}
+			}
+			return n
+		}
+		rnd := rand.New(rand.NewSource(1))
+		for r := 0; r < 50; r++ {
+			start := rnd.Intn(testCount)
+			end := start + rnd.Intn(testCount/10)
+			want := drop(start, end)
+			n, err := bt.DeleteRange(Int64ToBytes(int64(start)), Int64ToBytes(int64(end)))
+			if n != want || err != nil {
+				t.Fatalf("delete range [%d, %d]: want = %d, got = %d, %v", start, end, want, n, err)
+			}
+		}
+		verifyTree(bt, len(keys), t)
+		if n, _ := bt.Len(); n != len(keys) {
+			t.Errorf("len: want = %d, got = %d", len(keys), n)
+		}
+		for i := 0; i < testCount; i += 7 {
+			if _, ok, _ := bt.Search(Int64ToBytes(int64(i))); ok != keys[i] {
+				t.Errorf("search %d: want = %v, got = %v", i, keys[i], ok)
+			}
+		}
+
+		// unbounded ranges
+		if n, _ := bt.DeleteRange(nil, Int64ToBytes(999)); n != drop(0, 999) {
+			t.Errorf("delete range below: got = %d", n)
+		}
+		if n, _ := bt.DeleteRange(Int64ToBytes(int64(testCount-1000)), nil); n != drop(testCount-1000, testCount) {
+			t.Errorf("delete range above: got = %d", n)
+		}
+		verifyTree(bt, len(keys), t)
+
+		// only the boundary paths of a committed tree are loaded
+		loaded, err := LoadBTree(db, root, defaultKeyLength, bytes.Compare, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := loaded.DeleteRange(Int64ToBytes(1000), Int64ToBytes(int64(testCount-1000))); n != testCount-1999 || err != nil {
+			t.Errorf("delete range of loaded tree: want = %d, got = %d, %v", testCount-1999, n, err)
+		}
+		if loaded.leaf > 8 {
+			t.Errorf("loaded leaves: want <= 8, got = %d", loaded.leaf)
+		}
+		if it := loaded.Iterate(Int64ToBytes(998), Int64ToBytes(int64(testCount-998))); !it.Next() || BytesToInt64(it.Key()) != 998 ||
+			!it.Next() || BytesToInt64(it.Key()) != 999 || !it.Next() || BytesToInt64(it.Key()) != int64(testCount-999) {
+			t.Errorf("iterate around deleted range: stopped at %v", it.Err())
+		}
+	}
+}
+
+// taggedDatabase is a db whose type is not comparable.
+type taggedDatabase struct {
+	Database
+	tags map[string]bool
+}
+
+func TestSplitJoin(t *testing.T) {
+	testCount := 100000
+	newTree := func(db Database, from, to int) *BTree {
+		bt := NewBTree(db, defaultKeyLength, bytes.Compare)
+		for i := from; i < to; i++ {
+			bt.Insert(Int64ToBytes(int64(i)), []byte(fmt.Sprintf("%d", i)))
+		}
+		return bt
+	}
+	verifySide := func(bt *BTree, from, to int) {
+		t.Helper()
+		// the leaf of a tree with a single leaf may underflow
+		if to-from >= MaxKV {
+			verifyTree(bt, to-from, t)
+		}
+		if n, _ := bt.Len(); n != to-from {
+			t.Errorf("len: want = %d, got = %d", to-from, n)
+		}
+		i := from
+		for it := bt.Iterate(nil, nil); it.Next(); i++ {
+			if BytesToInt64(it.Key()) != int64(i) {
+				t.Fatalf("key %d: got = %d", i, BytesToInt64(it.Key()))
+			}
+		}
+		if i != to {
+			t.Errorf("iterate: want = %d, got = %d", to, i)
+		}
+	}
+
+	for _, pivot := range []int{0, 1, 254, 1000, testCount / 2, testCount - 1, testCount} {
+		db := NewMemDatabase()
+		bt := newTree(db, 0, testCount)
+		left, right, err := bt.Split(Int64ToBytes(int64(pivot)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifySide(left, 0, pivot)
+		verifySide(right, pivot, testCount)
+
+		// the split trees can be updated and committed
+		left.Insert(Int64ToBytes(int64(testCount+1)), []byte("left"))
+		right.Insert(Int64ToBytes(int64(testCount+2)), []byte("right"))
+		left.Delete(Int64ToBytes(int64(testCount + 1)))
+		right.Delete(Int64ToBytes(int64(testCount + 2)))
+		if err := left.Commit(nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := right.Commit(nil); err != nil {
+			t.Fatal(err)
+		}
+
+		joined, err := Join(left, right)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifySide(joined, 0, testCount)
+		if err := joined.Commit(nil); err != nil {
+			t.Fatal(err)
+		}
+		loaded, _ := LoadBTree(db, joined.RootHash(), defaultKeyLength, bytes.Compare)
+		if n, _ := loaded.Len(); n != testCount {
+			t.Errorf("len after reload: want = %d, got = %d", testCount, n)
+		}
+	}
+
+	// trees of different heights
+	for _, sizes := range [][2]int{{10, testCount}, {testCount, 10}, {300, 300}, {1, 1}} {
+		db := NewMemDatabase()
+		left := newTree(db, 0, sizes[0])
+		right := newTree(db, sizes[0], sizes[0]+sizes[1])
+		joined, err := Join(left, right)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifySide(joined, 0, sizes[0]+sizes[1])
+	}
+
+	shared := NewMemDatabase()
+	left, right := newTree(shared, 0, 100), newTree(shared, 99, 200)
+	if _, err := Join(left, right); err != ErrOverlap {
+		t.Errorf("join overlapping: want = %v, got = %v", ErrOverlap, err)
+	}
+	if _, err := Join(left, left); err != ErrSameTree {
+		t.Errorf("join with itself: want = %v, got = %v", ErrSameTree, err)
+	}
+	other := newTree(NewMemDatabase(), 200, 300)
+	if _, err := Join(right, other); err != ErrIncompatibleTrees {
+		t.Errorf("join trees of different dbs: want = %v, got = %v", ErrIncompatibleTrees, err)
+	}
+	reversed := NewBTree(shared, defaultKeyLength, func(key1, key2 []byte) int { return bytes.Compare(key2, key1) })
+	if _, err := Join(right, reversed); err != ErrIncompatibleTrees {
+		t.Errorf("join trees of different orders: want = %v, got = %v", ErrIncompatibleTrees, err)
+	}
+
+	// a db whose type is not comparable fails the join, without panicking
+	tagged := taggedDatabase{Database: shared, tags: map[string]bool{}}
+	if _, err := Join(NewBTree(tagged, defaultKeyLength, bytes.Compare), NewBTree(tagged, defaultKeyLength, bytes.Compare)); err != ErrIncompatibleTrees {
+		t.Errorf("join trees of a not comparable db: want = %v, got = %v", ErrIncompatibleTrees, err)
+	}
+
+	// the join with an empty tree has the options of left and no WAL either
+	dir, err := ioutil.TempDir("", "bplustree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sum := SumAggregator(BytesToInt64)
+	for _, empty := range []string{"left", "right"} {
+		wal, err := OpenWAL(filepath.Join(dir, empty))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wal.Close()
+		left := NewBTree(shared, defaultKeyLength, bytes.Compare, WithAggregator(sum), WithEncoding(CompactEncoding))
+		right := NewBTree(shared, defaultKeyLength, bytes.Compare)
+		full := right
+		if empty == "right" {
+			full = left
+		}
+		if err := full.AttachWAL(wal); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			full.Insert(Int64ToBytes(int64(i)), Int64ToBytes(1))
+		}
+		joined, err := Join(left, right)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if joined == left || joined == right || joined.wal != nil {
+			t.Errorf("join with empty %s: want a new tree without WAL", empty)
+		}
+		if joined.aggregator != sum || joined.encoding != CompactEncoding {
+			t.Errorf("join with empty %s: want the options of left", empty)
+		}
+		verifySide(joined, 0, 1000)
+		if agg, err := joined.AggregateRange(Int64ToBytes(0), Int64ToBytes(999)); err != nil || BytesToInt64(agg) != 1000 {
+			t.Errorf("aggregate of join with empty %s: want = 1000, got = %d, %v", empty, BytesToInt64(agg), err)
+		}
+		if err := joined.Commit(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// concurrent joins of the same trees in both orders don't wait for each
+	// other
+	a := NewBTree(shared, defaultKeyLength, bytes.Compare, WithConcurrency())
+	b := NewBTree(shared, defaultKeyLength, bytes.Compare, WithConcurrency())
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() { defer wg.Done(); Join(a, b) }()
+		go func() { defer wg.Done(); Join(b, a) }()
+	}
+	wg.Wait()
+
+	// only the path to the pivot and its neighbours are loaded
+	db := NewMemDatabase()
+	bt := newTree(db, 0, testCount)
+	bt.Commit(nil)
+	loaded, err := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left, right, err = loaded.Split(Int64ToBytes(int64(testCount / 3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left.leaf+right.leaf > 8 {
+		t.Errorf("loaded leaves: want <= 8, got = %d", left.leaf+right.leaf)
+	}
+	leftLen, _ := left.Len()
+	rightLen, _ := right.Len()
+	if leftLen != testCount/3 || rightLen != testCount-testCount/3 {
+		t.Errorf("len: want = %d, %d, got = %d, %d", testCount/3, testCount-testCount/3, leftLen, rightLen)
+	}
+	if err := right.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ = LoadBTree(db, right.RootHash(), defaultKeyLength, bytes.Compare)
+	if v, ok, _ := loaded.Search(Int64ToBytes(int64(testCount / 2))); !ok || string(v) != fmt.Sprintf("%d", testCount/2) {
+		t.Errorf("search right: got = %s, %v", v, ok)
+	}
+}
+
+// storeV0 stores the subtree of the node stored under hash in the format
+// preceding the node header, and returns the hash of the stored node.
+func storeV0(db Database, hash []byte, t *testing.T) []byte {
+	data, err := db.Get(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := decodeNode(data, defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in, ok := n.(*InteriorNode); ok {
+		for i := 0; i < in.Count; i++ {
+			child := in.Kcs.data[i].Child.(*HashNode)
+			child.Hash = storeV0(db, child.Hash, t)
+		}
+	}
+	data = encodeV0(n)
+	hash = SHA3.sum(data)
+	db.Put(hash, data)
+	return hash
+}
+
+// encodeV0 encodes n as it was stored before the node header, the KCs of
+// interior nodes having no Size and no Agg.
+func encodeV0(n Node) []byte {
+	in, ok := n.(*InteriorNode)
+	if !ok {
+		return n.encode()
+	}
+	data := append([]byte{prefixInterior}, Int32ToBytes(int32(in.Count))...)
+	for i := 0; i < in.Count; i++ {
+		kc := in.Kcs.data[i]
+		_, hash, _ := kc.Child.cache()
+		data = append(data, Int32ToBytes(int32(len(kc.Key)))...)
+		data = append(data, kc.Key...)
+		data = append(data, Int32ToBytes(int32(len(hash)))...)
+		data = append(data, hash...)
+	}
+	return data
+}
+
+func TestNodeFormat(t *testing.T) {
+	testCount := 10000
+	sum := SumAggregator(BytesToInt64)
+	db := NewMemDatabase()
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare, WithAggregator(sum))
+	for i := 0; i < testCount; i++ {
+		bt.Insert(Int64ToBytes(int64(i)), Int64ToBytes(int64(i)))
+	}
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := db.Get(bt.RootHash()); data[0] != formatMagic || data[1] != formatVersion || Hasher(data[2]) != SHA3 {
+		t.Fatalf("root header: got = %x", data[:headerSize])
+	}
+
+	// a tree stored before the header loads, and commits in the current format
+	old := storeV0(db, bt.RootHash(), t)
+	loaded, err := LoadBTree(db, old, defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolveAll(loaded, loaded.root, t)
+	verifyTree(loaded, testCount, t)
+	loaded.Insert(Int64ToBytes(int64(testCount)), []byte("v"))
+	if err := loaded.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := LoadBTree(db, loaded.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatalf("load updated tree: %v", err)
+	}
+	verifyRanks(updated, testCount+1, 1, t)
+
+	// the Sizes and Aggs missing from the old nodes are computed from their
+	// subtrees
+	counted, err := LoadBTree(db, old, defaultKeyLength, bytes.Compare, WithAggregator(sum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyRanks(counted, testCount, 1, t)
+	if agg, err := counted.AggregateRange(Int64ToBytes(0), Int64ToBytes(999)); err != nil || BytesToInt64(agg) != 999*1000/2 {
+		t.Errorf("aggregate old tree: want = %d, got = %d, %v", 999*1000/2, BytesToInt64(agg), err)
+	}
+
+	// migrating the old tree gives back the tree in the current format, with
+	// the Sizes and Aggs computed
+	root, err := Migrate(db, old, defaultKeyLength, bytes.Compare, WithAggregator(sum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(root, bt.RootHash()) {
+		t.Errorf("migrate: want = %x, got = %x", bt.RootHash(), root)
+	}
+
+	// and to another hasher
+	root, err = Migrate(db, old, defaultKeyLength, bytes.Compare, WithHasher(SHA256), WithAggregator(sum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated, err := LoadBTree(db, root, defaultKeyLength, bytes.Compare, WithAggregator(sum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated.hasher != SHA256 {
+		t.Errorf("hasher of migrated tree: want = %d, got = %d", SHA256, migrated.hasher)
+	}
+	resolveAll(migrated, migrated.root, t)
+	verifyTree(migrated, testCount, t)
+	migrated.Insert(Int64ToBytes(int64(testCount)), Int64ToBytes(0))
+	if err := migrated.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	start, end := Int64ToBytes(10), Int64ToBytes(20)
+	agg, proof, err := migrated.ProveAggregateRange(start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyAggregateRange(migrated.RootHash(), start, end, agg, proof, defaultKeyLength, bytes.Compare, sum); err != nil {
+		t.Errorf("verify proof of SHA256 tree: %v", err)
+	}
+	nodes := 0
+	err = Reachable(db, migrated.RootHash(), defaultKeyLength, bytes.Compare, func(key []byte, blob bool) error {
+		nodes++
+		return nil
+	})
+	if err != nil || nodes != migrated.leaf+migrated.interior {
+		t.Errorf("reachable nodes of SHA256 tree: want = %d, got = %d, %v", migrated.leaf+migrated.interior, nodes, err)
+	}
+
+	if _, err := LoadBTree(db, root, defaultKeyLength, bytes.Compare, WithHasher(SHA3)); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("load with another hasher: want = %v, got = %v", ErrUnsupportedFormat, err)
+	}
+	if _, err := LoadBTree(db, old, defaultKeyLength, bytes.Compare, WithHasher(SHA256)); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("load old tree with SHA256: want = %v, got = %v", ErrUnsupportedFormat, err)
+	}
+
+	// a node of version 1 has no encoding byte
+	data, _ := db.Get(bt.RootHash())
+	v1 := append([]byte{formatMagic, 1}, data[2:5]...)
+	v1 = append(v1, data[headerSize:]...)
+	db.Put(SHA3.sum(v1), v1)
+	if _, err := LoadBTree(db, SHA3.sum(v1), defaultKeyLength, bytes.Compare); err != nil {
+		t.Errorf("load version 1 root: %v", err)
+	}
+
+	// unsupported headers
+	for _, c := range []struct {
+		i int
+		b byte
+	}{{1, formatVersion + 1}, {1, 0}, {2, 0}, {2, 9}, {3, 0xff}, {5, 9}} {
+		bad := CopyBytes(data)
+		bad[c.i] = c.b
+		db.Put(SHA3.sum(bad), bad)
+		if _, err := LoadBTree(db, SHA3.sum(bad), defaultKeyLength, bytes.Compare); !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("load header %x: want = %v, got = %v", bad[:headerSize], ErrUnsupportedFormat, err)
+		}
+	}
+}
+
+func TestCompactEncoding(t *testing.T) {
+	testCount := 20000
+	db := NewMemDatabase()
+	fixed := NewBTree(db, defaultKeyLength, bytes.Compare)
+	compact := NewBTree(db, defaultKeyLength, bytes.Compare, WithEncoding(CompactEncoding))
+	for i := 0; i < testCount; i++ {
+		key, value := Int64ToBytes(int64(i)), []byte(fmt.Sprintf("%d", i))
+		fixed.Insert(key, value)
+		compact.Insert(key, value)
+	}
+	// a Key shorter than the next ones
+	compact.Insert([]byte{0, 0, 1}, []byte("short"))
+	fixed.Insert([]byte{0, 0, 1}, []byte("short"))
+	if err := fixed.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := compact.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	size := func(root []byte) int {
+		loaded, err := LoadBTree(db, root, defaultKeyLength, bytes.Compare)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolveAll(loaded, loaded.root, t)
+		verifyTree(loaded, testCount+1, t)
+		return int(loaded.loaded)
+	}
+	fixedSize, compactSize := size(fixed.RootHash()), size(compact.RootHash())
+	if compactSize*2 > fixedSize {
+		t.Errorf("compact size: want < %d, got = %d", fixedSize/2, compactSize)
+	}
+
+	loaded, err := LoadBTree(db, compact.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.encoding != CompactEncoding {
+		t.Errorf("encoding of loaded tree: want = %d, got = %d", CompactEncoding, loaded.encoding)
+	}
+
+	// the encoding is inherited whatever the other options, unless it is given
+	withHasher, err := LoadBTree(db, compact.RootHash(), defaultKeyLength, bytes.Compare, WithHasher(SHA3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withHasher.encoding != CompactEncoding {
+		t.Errorf("encoding of tree loaded with hasher: want = %d, got = %d", CompactEncoding, withHasher.encoding)
+	}
+	withFixed, err := LoadBTree(db, compact.RootHash(), defaultKeyLength, bytes.Compare, WithEncoding(FixedEncoding))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withFixed.encoding != FixedEncoding {
+		t.Errorf("encoding of tree loaded with FixedEncoding: want = %d, got = %d", FixedEncoding, withFixed.encoding)
+	}
+	for _, key := range [][]byte{{0, 0, 1}, Int64ToBytes(0), Int64ToBytes(int64(testCount - 1))} {
+		if _, ok, err := loaded.Search(key); err != nil || !ok {
+			t.Errorf("search %x: got = %v, %v", key, ok, err)
+		}
+	}
+
+	// the trees migrate from an encoding to the other
+	root, err := Migrate(db, fixed.RootHash(), defaultKeyLength, bytes.Compare, WithEncoding(CompactEncoding))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(root, compact.RootHash()) {
+		t.Errorf("migrate to compact: want = %x, got = %x", compact.RootHash(), root)
+	}
+	root, err = Migrate(db, compact.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(root, fixed.RootHash()) {
+		t.Errorf("migrate to fixed: want = %x, got = %x", fixed.RootHash(), root)
+	}
+
+	leaf := loaded.first
+	_, _, data := leaf.cache()
+	payload := data[headerSize:]
+
+	// every truncation of a stored node fails to decode
+	for i := 0; i < len(payload); i++ {
+		if _, _, err := decodeNode(append(CopyBytes(data[:headerSize]), payload[:i]...), defaultKeyLength, bytes.Compare); err == nil {
+			t.Fatalf("decode node truncated to %d bytes: want error, got nil", i)
+		}
+	}
+}
+
+// verifyBounds checks that the Keys under n are within [lo, hi).
+func verifyBounds(bt *BTree, n Node, lo, hi []byte, t *testing.T) {
+	switch nn := n.(type) {
+	case *InteriorNode:
+		for i := 0; i < nn.Count; i++ {
+			clo, chi := lo, hi
+			if i > 0 {
+				clo = nn.Kcs.data[i-1].Key
+			}
+			if i < nn.Count-1 {
+				chi = nn.Kcs.data[i].Key
+			}
+			verifyBounds(bt, nn.Kcs.data[i].Child, clo, chi, t)
+		}
+	case *LeafNode:
+		for i := 0; i < nn.Count; i++ {
+			key := nn.Kvs.data[i].Key
+			if (lo != nil && bt.cmpFunc(key, lo) < 0) || (hi != nil && bt.cmpFunc(key, hi) >= 0) {
+				t.Errorf("leaf key %q out of bounds [%q, %q)", key, lo, hi)
+			}
+		}
+	}
+}
+
+func TestSeparator(t *testing.T) {
+	for _, c := range []struct{ left, right, sep string }{
+		{"abc", "abd", "abd"},
+		{"abc", "abzzz", "abz"},
+		{"ab", "abc", "abc"},
+		{"", "b", "b"},
+		{"user/0001/x", "user/0002/x", "user/0002"},
+	} {
+		if sep := ShortestSeparator([]byte(c.left), []byte(c.right)); string(sep) != c.sep {
+			t.Errorf("separator of %q and %q: want = %q, got = %q", c.left, c.right, c.sep, sep)
+		}
+	}
+
+	testCount := 20000
+	keyLen := 32
+	key := func(i int) []byte { return []byte(fmt.Sprintf("user/%08d/profile/settings", i)) }
+	db := NewMemDatabase()
+	full := NewBTree(db, keyLen, bytes.Compare)
+	short := NewBTree(db, keyLen, bytes.Compare, WithSeparator(ShortestSeparator))
+	r := rand.New(rand.NewSource(1))
+	keys := make(map[int]bool)
+	for _, i := range r.Perm(testCount) {
+		full.Insert(key(i), []byte("v"))
+		short.Insert(key(i), []byte("v"))
+		keys[i] = true
+	}
+	for i := 0; i < testCount; i += 3 {
+		full.Delete(key(i))
+		short.Delete(key(i))
+		delete(keys, i)
+	}
+	verifyTree(short, len(keys), t)
+	verifyBounds(short, short.root, nil, nil, t)
+	if sep := short.root.Kcs.data[0].Key; len(sep) >= len(key(0)) {
+		t.Errorf("separator of the root: want shorter than a Key, got = %q", sep)
+	}
+
+	if err := full.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := short.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	interiorSize := func(bt *BTree) int {
+		_, _, data := bt.root.cache()
+		size := len(data)
+		for i := 0; i < bt.root.Count; i++ {
+			if in, ok := bt.root.Kcs.data[i].Child.(*InteriorNode); ok {
+				_, _, data := in.cache()
+				size += len(data)
+			}
+		}
+		return size
+	}
+	if f, s := interiorSize(full), interiorSize(short); s >= f {
+		t.Errorf("size of the interior nodes: want < %d, got = %d", f, s)
+	}
+
+	// every query finds the Keys through the separators
+	loaded, err := LoadBTree(db, short.RootHash(), keyLen, bytes.Compare, WithSeparator(ShortestSeparator))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bt := range []*BTree{short, loaded} {
+		for i := 0; i < testCount; i++ {
+			if _, ok, err := bt.Search(key(i)); err != nil || ok != keys[i] {
+				t.Errorf("search %q: want = %v, got = %v, %v", key(i), keys[i], ok, err)
+			}
+		}
+		n := 0
+		for it := bt.ScanPrefix([]byte("user/0001")); it.Next(); n++ {
+		}
+		if n != 6667 {
+			t.Errorf("scan prefix: want = 6667, got = %d", n)
+		}
+		kv, ok, err := bt.Ceiling([]byte("user/00000128"))
+		if err != nil || !ok || string(kv.Key) != string(key(128)) {
+			t.Errorf("ceiling: got = %q, %v, %v", kv.Key, ok, err)
+		}
+	}
+
+	left, right, err := short.Split(key(10001))
+	if err != nil {
+		t.Fatal(err)
+	}
+	joined, err := Join(left, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyBounds(joined, joined.root, nil, nil, t)
+	if err := joined.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := joined.Search(key(10001)); err != nil || !ok {
+		t.Errorf("search joined tree: got = %v, %v", ok, err)
+	}
+}
+
+// fullLeaf returns a leaf holding MaxKV KVs.
+// decodeNode decodes the stored node data.
+func decodeNode(data []byte, keyLen int, cmpFunc func(key1, key2 []byte) int) (Node, nodeHeader, error) {
+	h, data, err := readHeader(data)
+	if err != nil {
+		return nil, h, err
+	}
+	if data, err = decompress(h.compression, data); err != nil {
+		return nil, h, err
+	}
+	n, err := decodePayload(h, data, keyLen, cmpFunc)
+	return n, h, err
+}
+
+func fullLeaf() *LeafNode {
+	leaf := newLeafNode(nil, defaultKeyLength, bytes.Compare)
+	for i := 0; i < MaxKV; i++ {
+		leaf.Kvs.data[i] = leafKV{KV: KV{Int64ToBytes(int64(i)), []byte(fmt.Sprintf("value %d", i))}}
+	}
+	leaf.Kvs.data[1].Value = nil
+	leaf.Count = MaxKV
+	return leaf
+}
+
+// fullInterior returns an interior node holding MaxKC unresolved children.
+func fullInterior() *InteriorNode {
+	in := newInteriorNode(nil, nil, defaultKeyLength, bytes.Compare)
+	for i := 0; i < MaxKC; i++ {
+		hash := SHA3.sum(Int64ToBytes(int64(i)))
+		in.Kcs.data[i] = KC{Key: Int64ToBytes(int64(i)), Child: newHashNode(in, hash, defaultKeyLength), Size: i * 1000}
+		if i%2 == 0 {
+			in.Kcs.data[i].Agg = Int64ToBytes(int64(i))
+		}
+	}
+	in.Count = MaxKC
+	return in
+}
+
+func TestNodeCodecs(t *testing.T) {
+	leaf, in := fullLeaf(), fullInterior()
+	for e, codec := range nodeCodecs {
+		data := codec.encodeLeaf(leaf)
+		l := newLeafNode(nil, defaultKeyLength, bytes.Compare)
+		if err := codec.decodeLeaf(l, data); err != nil {
+			t.Fatalf("encoding %d: decode leaf: %v", e, err)
+		}
+		if l.Count != leaf.Count {
+			t.Errorf("encoding %d: leaf count: want = %d, got = %d", e, leaf.Count, l.Count)
+		}
+		for i := 0; i < leaf.Count; i++ {
+			if want, got := leaf.Kvs.data[i], l.Kvs.data[i]; !bytes.Equal(want.Key, got.Key) || !bytes.Equal(want.Value, got.Value) {
+				t.Errorf("encoding %d: KV %d: want = %v, got = %v", e, i, want, got)
+			}
+		}
+
+		data = codec.encodeInterior(in)
+		n := newInteriorNode(nil, nil, defaultKeyLength, bytes.Compare)
+		if err := codec.decodeInterior(n, data); err != nil {
+			t.Fatalf("encoding %d: decode interior: %v", e, err)
+		}
+		if n.Count != in.Count {
+			t.Errorf("encoding %d: interior count: want = %d, got = %d", e, in.Count, n.Count)
+		}
+		for i := 0; i < in.Count; i++ {
+			want, got := in.Kcs.data[i], n.Kcs.data[i]
+			if !bytes.Equal(want.Key, got.Key) || want.Size != got.Size || !bytes.Equal(want.Agg, got.Agg) || (want.Agg == nil) != (got.Agg == nil) ||
+				!bytes.Equal(want.Child.(*HashNode).Hash, got.Child.(*HashNode).Hash) {
+				t.Errorf("encoding %d: KC %d: want = %v, got = %v", e, i, want, got)
+			}
+		}
+
+		// truncated and empty encodings fail to decode
+		for _, bad := range [][]byte{data[:len(data)-1], data[:1], {prefixInterior}} {
+			if err := codec.decodeInterior(newInteriorNode(nil, nil, defaultKeyLength, bytes.Compare), bad); err == nil {
+				t.Errorf("encoding %d: decode %d bytes: want error, got nil", e, len(bad))
+			}
+		}
+	}
+
+	// the trees store and migrate across the encodings
+	db := NewMemDatabase()
+	var roots [][]byte
+	for e := range nodeCodecs {
+		bt := NewBTree(db, defaultKeyLength, bytes.Compare, WithEncoding(Encoding(e)))
+		for i := 0; i < 10000; i++ {
+			bt.Insert(Int64ToBytes(int64(i)), []byte(fmt.Sprintf("%d", i)))
+		}
+		if err := bt.Commit(nil); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolveAll(loaded, loaded.root, t)
+		verifyTree(loaded, 10000, t)
+		roots = append(roots, bt.RootHash())
+	}
+	root, err := Migrate(db, roots[FixedEncoding], defaultKeyLength, bytes.Compare, WithEncoding(MsgpEncoding))
+	if err != nil || !bytes.Equal(root, roots[MsgpEncoding]) {
+		t.Errorf("migrate to msgp: want = %x, got = %x, %v", roots[MsgpEncoding], root, err)
+	}
+}
+
+func benchmarkCodecs(b *testing.B, bench func(b *testing.B, codec nodeCodec)) {
+	for _, c := range []struct {
+		name string
+		e    Encoding
+	}{{"fixed", FixedEncoding}, {"compact", CompactEncoding}, {"msgp", MsgpEncoding}} {
+		b.Run(c.name, func(b *testing.B) { bench(b, nodeCodecs[c.e]) })
+	}
+}
+
+func BenchmarkEncodeLeaf(b *testing.B) {
+	leaf := fullLeaf()
+	benchmarkCodecs(b, func(b *testing.B, codec nodeCodec) {
+		b.SetBytes(int64(len(codec.encodeLeaf(leaf))))
+		for i := 0; i < b.N; i++ {
+			codec.encodeLeaf(leaf)
+		}
+	})
+}
+
+func BenchmarkDecodeLeaf(b *testing.B) {
+	leaf := fullLeaf()
+	benchmarkCodecs(b, func(b *testing.B, codec nodeCodec) {
+		data := codec.encodeLeaf(leaf)
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			codec.decodeLeaf(newLeafNode(nil, defaultKeyLength, bytes.Compare), data)
+		}
+	})
+}
+
+func BenchmarkEncodeInterior(b *testing.B) {
+	in := fullInterior()
+	benchmarkCodecs(b, func(b *testing.B, codec nodeCodec) {
+		b.SetBytes(int64(len(codec.encodeInterior(in))))
+		for i := 0; i < b.N; i++ {
+			codec.encodeInterior(in)
+		}
+	})
+}
+
+func BenchmarkDecodeInterior(b *testing.B) {
+	in := fullInterior()
+	benchmarkCodecs(b, func(b *testing.B, codec nodeCodec) {
+		data := codec.encodeInterior(in)
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			codec.decodeInterior(newInteriorNode(nil, nil, defaultKeyLength, bytes.Compare), data)
+		}
+	})
+}
+
+func TestCompression(t *testing.T) {
+	testCount := 20000
+	sum := SumAggregator(BytesToInt64)
+	value := func(i int) []byte { return append(Int64ToBytes(int64(i%10)), bytes.Repeat([]byte("value"), 20)...) }
+	db := NewMemDatabase()
+	raw := NewBTree(db, defaultKeyLength, bytes.Compare, WithAggregator(sum))
+	compressed := NewBTree(db, defaultKeyLength, bytes.Compare, WithAggregator(sum), WithCompression(FlateCompression, DefaultCompressionThreshold))
+	for i := 0; i < testCount; i++ {
+		raw.Insert(Int64ToBytes(int64(i)), value(i))
+		compressed.Insert(Int64ToBytes(int64(i)), value(i))
+	}
+	if err := raw.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := compressed.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the hashes are computed over the uncompressed nodes
+	if !bytes.Equal(raw.RootHash(), compressed.RootHash()) {
+		t.Fatalf("root hash: want = %x, got = %x", raw.RootHash(), compressed.RootHash())
+	}
+	leaf, _ := compressed.First()
+	_, hash, data := leaf.cache()
+	if data[compressionOffset] != byte(FlateCompression) {
+		t.Errorf("compression of a leaf: want = %d, got = %d", FlateCompression, data[compressionOffset])
+	}
+	if stored, _ := db.Get(hash); !bytes.Equal(stored, data) {
+		t.Errorf("stored leaf: want the compressed leaf")
+	}
+	_, _, rawData := raw.first.cache()
+	if len(data)*3 > len(rawData) {
+		t.Errorf("size of compressed leaf: want < %d, got = %d", len(rawData)/3, len(data))
+	}
+
+	loaded, err := LoadBTree(db, compressed.RootHash(), defaultKeyLength, bytes.Compare, WithAggregator(sum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolveAll(loaded, loaded.root, t)
+	verifyTree(loaded, testCount, t)
+	if v, ok, err := loaded.Search(Int64ToBytes(1234)); err != nil || !ok || !bytes.Equal(v, value(1234)) {
+		t.Errorf("search: got = %x, %v, %v", v, ok, err)
+	}
+
+	// the proofs made of compressed nodes are verified
+	start, end := Int64ToBytes(100), Int64ToBytes(5000)
+	agg, proof, err := compressed.ProveAggregateRange(start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyAggregateRange(compressed.RootHash(), start, end, agg, proof, defaultKeyLength, bytes.Compare, sum); err != nil {
+		t.Errorf("verify proof: %v", err)
+	}
+
+	// the nodes below the threshold are stored raw
+	small := NewBTree(db, defaultKeyLength, bytes.Compare, WithCompression(FlateCompression, 1<<20))
+	small.Insert(Int64ToBytes(0), value(0))
+	if err := small.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, data := small.first.cache(); data[compressionOffset] != byte(NoCompression) {
+		t.Errorf("compression of a small leaf: want = %d, got = %d", NoCompression, data[compressionOffset])
+	}
+
+	// the trees migrate to and from compression without changing their hash
+	root, err := Migrate(db, compressed.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil || !bytes.Equal(root, raw.RootHash()) {
+		t.Errorf("migrate: want = %x, got = %x, %v", raw.RootHash(), root, err)
+	}
+
+	// an unknown compression is rejected before anything is written
+	unknown := NewBTree(db, defaultKeyLength, bytes.Compare, WithCompression(FlateCompression+1, 0))
+	unknown.Insert(Int64ToBytes(0), value(0))
+	if err := unknown.Commit(nil); err != ErrUnsupportedFormat {
+		t.Errorf("commit with unknown compression: want = %v, got = %v", ErrUnsupportedFormat, err)
+	}
+	if unknown.RootHash() != nil {
+		t.Errorf("root hash with unknown compression: want = nil, got = %x", unknown.RootHash())
+	}
+	if _, err := Migrate(db, raw.RootHash(), defaultKeyLength, bytes.Compare, WithCompression(FlateCompression+1, 0)); err != ErrUnsupportedFormat {
+		t.Errorf("migrate with unknown compression: want = %v, got = %v", ErrUnsupportedFormat, err)
+	}
+
+	// a truncated compressed node fails to decode
+	if _, _, err := decodeNode(data[:len(data)-5], defaultKeyLength, bytes.Compare); err != ErrCorruptNode {
+		t.Errorf("decode truncated node: want = %v, got = %v", ErrCorruptNode, err)
+	}
+
+	// a node of version 2 has no compression byte
+	_, _, data = raw.root.cache()
+	v2 := append([]byte{formatMagic, 2}, data[2:6]...)
+	v2 = append(v2, data[headerSize:]...)
+	db.Put(SHA3.sum(v2), v2)
+	if _, err := LoadBTree(db, SHA3.sum(v2), defaultKeyLength, bytes.Compare); err != nil {
+		t.Errorf("load version 2 root: %v", err)
+	}
+}
+
+// countingBatch counts the puts of the writes.
+type countingBatch struct {
+	Batch
+	puts int
+}
+
+func (b *countingBatch) Put(key, value []byte) error {
+	b.puts++
+	return b.Batch.Put(key, value)
+}
+
+func TestBlobs(t *testing.T) {
+	testCount := 2000
+	value := func(i int) []byte {
+		if i%2 == 0 {
+			return bytes.Repeat([]byte(fmt.Sprintf("large%06d", i)), 20)
+		}
+		return []byte(fmt.Sprintf("%d", i))
+	}
+	db := NewMemDatabase()
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare, WithBlobs(64))
+	for i := 0; i < testCount; i++ {
+		bt.Insert(Int64ToBytes(int64(i)), value(i))
+	}
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the blobs of the Values which didn't change are not written again
+	bt.Insert(Int64ToBytes(1), []byte("updated"))
+	batch := &countingBatch{Batch: db.NewBatch()}
+	if err := bt.Commit(batch); err != nil {
+		t.Fatal(err)
+	}
+	if batch.puts != bt.height {
+		t.Errorf("puts of the commit: want = %d, got = %d", bt.height, batch.puts)
+	}
+	bt.Insert(Int64ToBytes(1), value(1))
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the leaves hold the hashes of the large Values, stored as blobs
+	_, _, data := bt.first.cache()
+	if data[flagsOffset]&flagBlobs == 0 || bytes.Contains(data, value(0)) {
+		t.Errorf("stored leaf: want the large Values out of line")
+	}
+	if blob, err := db.Get(SHA3.sum(value(0))); err != nil || !bytes.Equal(blob, value(0)) {
+		t.Errorf("blob: got = %q, %v", blob, err)
+	}
+
+	loaded, err := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare, WithBlobs(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < testCount; i += 7 {
+		if v, ok, err := loaded.Search(Int64ToBytes(int64(i))); err != nil || !ok || !bytes.Equal(v, value(i)) {
+			t.Fatalf("search %d: got = %q, %v, %v", i, v, ok, err)
+		}
+	}
+	kvs, err := loaded.SearchRange(Int64ToBytes(100), Int64ToBytes(199))
+	if err != nil || len(kvs) != 100 {
+		t.Fatalf("search range: got = %d, %v", len(kvs), err)
+	}
+	for i, kv := range kvs {
+		if !bytes.Equal(kv.Value, value(100+i)) {
+			t.Fatalf("search range %d: got = %q", 100+i, kv.Value)
+		}
+	}
+	it := loaded.Iterate(nil, nil)
+	for i := 0; it.Next(); i++ {
+		if !bytes.Equal(it.Value(), value(i)) {
+			t.Fatalf("next %d: got = %q", i, it.Value())
+		}
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+
+	// an updated Value drops its reference to the blob
+	loaded.Insert(Int64ToBytes(0), []byte("small"))
+	loaded.Insert(Int64ToBytes(1), value(2))
+	if err := loaded.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := LoadBTree(db, loaded.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _, err := reloaded.Search(Int64ToBytes(0)); err != nil || string(v) != "small" {
+		t.Errorf("search updated: got = %q, %v", v, err)
+	}
+	if v, _, err := reloaded.Search(Int64ToBytes(1)); err != nil || !bytes.Equal(v, value(2)) {
+		t.Errorf("search updated: got = %q, %v", v, err)
+	}
+
+	// a missing or corrupt blob fails the Search, not the load of its leaf
+	broken := NewMemDatabase()
+	for _, key := range db.Keys() {
+		v, _ := db.Get(key)
+		broken.Put(key, v)
+	}
+	broken.Delete(SHA3.sum(value(2)))
+	broken.Put(SHA3.sum(value(4)), value(6))
+	loaded, err = LoadBTree(broken, bt.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nodeErr *NodeError
+	if _, _, err := loaded.Search(Int64ToBytes(2)); !errors.Is(err, ErrMissingNode) || !errors.As(err, &nodeErr) ||
+		!bytes.Equal(nodeErr.Hash, SHA3.sum(value(2))) {
+		t.Errorf("search missing blob: want = %v, got = %v", ErrMissingNode, err)
+	}
+	if _, _, err := loaded.Search(Int64ToBytes(4)); !errors.Is(err, ErrCorruptNode) {
+		t.Errorf("search corrupt blob: want = %v, got = %v", ErrCorruptNode, err)
+	}
+	if v, _, err := loaded.Search(Int64ToBytes(3)); err != nil || !bytes.Equal(v, value(3)) {
+		t.Errorf("search beside missing blob: got = %q, %v", v, err)
+	}
+
+	// the proofs hold the blob or not
+	key := Int64ToBytes(10)
+	v, ok, withBlob, err := bt.ProveSearch(key, true)
+	if err != nil || !ok || !bytes.Equal(v, value(10)) {
+		t.Fatalf("prove search: got = %q, %v, %v", v, ok, err)
+	}
+	_, _, withoutBlob, err := bt.ProveSearch(key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(withBlob.Blobs) != 1 || len(withoutBlob.Blobs) != 0 {
+		t.Errorf("proof blobs: want = 1, 0, got = %d, %d", len(withBlob.Blobs), len(withoutBlob.Blobs))
+	}
+	if len(withoutBlob.Nodes) != bt.height {
+		t.Errorf("proof nodes: want = %d, got = %d", bt.height, len(withoutBlob.Nodes))
+	}
+	if v, ok, err := VerifySearch(bt.RootHash(), key, withBlob, defaultKeyLength, bytes.Compare); err != nil || !ok || !bytes.Equal(v, value(10)) {
+		t.Errorf("verify search: got = %q, %v, %v", v, ok, err)
+	}
+	if _, _, err := VerifySearch(bt.RootHash(), key, withoutBlob, defaultKeyLength, bytes.Compare); err != ErrInvalidProof {
+		t.Errorf("verify search without blob: want = %v, got = %v", ErrInvalidProof, err)
+	}
+	if err := VerifyValue(bt.RootHash(), key, value(10), withoutBlob, defaultKeyLength, bytes.Compare); err != nil {
+		t.Errorf("verify value: %v", err)
+	}
+	if err := VerifyValue(bt.RootHash(), key, value(12), withoutBlob, defaultKeyLength, bytes.Compare); err != ErrInvalidProof {
+		t.Errorf("verify wrong value: want = %v, got = %v", ErrInvalidProof, err)
+	}
+	_, _, proof, err := bt.ProveSearch(Int64ToBytes(11), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyValue(bt.RootHash(), Int64ToBytes(11), value(11), proof, defaultKeyLength, bytes.Compare); err != nil {
+		t.Errorf("verify inline value: %v", err)
+	}
+	_, ok, proof, err = bt.ProveSearch(Int64ToBytes(int64(testCount)), true)
+	if err != nil || ok {
+		t.Fatalf("prove absent key: got = %v, %v", ok, err)
+	}
+	if _, ok, err := VerifySearch(bt.RootHash(), Int64ToBytes(int64(testCount)), proof, defaultKeyLength, bytes.Compare); err != nil || ok {
+		t.Errorf("verify absent key: got = %v, %v", ok, err)
+	}
+
+	// the trees migrate their Values inline and back out of line
+	inline, err := Migrate(db, bt.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := NewBTree(NewMemDatabase(), defaultKeyLength, bytes.Compare)
+	for i := 0; i < testCount; i++ {
+		plain.Insert(Int64ToBytes(int64(i)), value(i))
+	}
+	if err := plain.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(inline, plain.RootHash()) {
+		t.Errorf("migrate inline: want = %x, got = %x", plain.RootHash(), inline)
+	}
+	if root, err := Migrate(db, inline, defaultKeyLength, bytes.Compare, WithBlobs(64)); err != nil || !bytes.Equal(root, bt.RootHash()) {
+		t.Errorf("migrate out of line: want = %x, got = %x, %v", bt.RootHash(), root, err)
+	}
+
+	// collecting the keys not reachable from the last root keeps the tree whole
+	reachable := make(map[string]bool)
+	blobs := 0
+	err = Reachable(db, reloaded.RootHash(), defaultKeyLength, bytes.Compare, func(key []byte, blob bool) error {
+		reachable[string(key)] = true
+		if blob {
+			blobs++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blobs != testCount/2 {
+		t.Errorf("reachable blobs: want = %d, got = %d", testCount/2, blobs)
+	}
+	for _, key := range db.Keys() {
+		if !reachable[string(key)] {
+			db.Delete(key)
+		}
+	}
+	if db.Len() != len(reachable) {
+		t.Errorf("collected db: want = %d keys, got = %d", len(reachable), db.Len())
+	}
+	reloaded, err = LoadBTree(db, reloaded.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it = reloaded.Iterate(nil, nil)
+	for it.Next() {
+	}
+	if it.Err() != nil {
+		t.Errorf("iterate collected tree: %v", it.Err())
+	}
+	if _, err := db.Get(SHA3.sum(value(0))); err == nil {
+		t.Errorf("collected db: want the unreachable blob deleted")
+	}
+}
+
+func TestBlobAggregates(t *testing.T) {
+	testCount := 2000
+	value := func(i int) []byte {
+		if i%3 == 0 {
+			return bytes.Repeat([]byte{byte(i)}, 100+i%50)
+		}
+		return []byte(fmt.Sprintf("%d", i))
+	}
+	sum := SumAggregator(func(value []byte) int64 { return int64(len(value)) })
+	want := func(from, to int) int64 {
+		var total int64
+		for i := from; i <= to; i++ {
+			total += int64(len(value(i)))
+		}
+		return total
+	}
+	db := NewMemDatabase()
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare, WithBlobs(64), WithAggregator(sum))
+	for i := 0; i < testCount; i++ {
+		bt.Insert(Int64ToBytes(int64(i)), value(i))
+	}
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare, WithBlobs(64), WithAggregator(sum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges := [][2]int{{0, testCount - 1}, {3, 3}, {100, 1500}, {7, 8}}
+	for _, r := range ranges {
+		start, end := Int64ToBytes(int64(r[0])), Int64ToBytes(int64(r[1]))
+		for name, tree := range map[string]*BTree{"live": bt, "loaded": loaded} {
+			agg, err := tree.AggregateRange(start, end)
+			if err != nil || BytesToInt64(agg) != want(r[0], r[1]) {
+				t.Errorf("aggregate %s %v: want = %d, got = %d, %v", name, r, want(r[0], r[1]), BytesToInt64(agg), err)
+			}
+		}
+		agg, proof, err := bt.ProveAggregateRange(start, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyAggregateRange(bt.RootHash(), start, end, agg, proof, defaultKeyLength, bytes.Compare, sum); err != nil ||
+			BytesToInt64(agg) != want(r[0], r[1]) {
+			t.Errorf("prove aggregate %v: want = %d, got = %d, %v", r, want(r[0], r[1]), BytesToInt64(agg), err)
+		}
+	}
+
+	// the aggregates of the leaves loaded with their Values out of line are
+	// computed again on update, from the aggregates kept with the blobs
+	loaded.Insert(Int64ToBytes(1), []byte("updated"))
+	if err := loaded.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	agg, err := loaded.AggregateRange(nil, Int64ToBytes(int64(testCount)))
+	if total := want(0, testCount-1) - int64(len(value(1))) + int64(len("updated")); err != nil || BytesToInt64(agg) != total {
+		t.Errorf("aggregate after update: want = %d, got = %d, %v", total, BytesToInt64(agg), err)
+	}
+}
+
+func TestEncryptedDatabase(t *testing.T) {
+	testCount := 5000
+	oldKey, key := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+	value := func(i int) []byte { return []byte(fmt.Sprintf("secret%d", i)) }
+	raw := NewMemDatabase()
+	db, err := NewEncryptedDatabase(raw, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare, WithBlobs(64))
+	for i := 0; i < testCount; i++ {
+		bt.Insert(Int64ToBytes(int64(i)), value(i))
+	}
+	bt.Insert(Int64ToBytes(int64(testCount)), bytes.Repeat([]byte("secret"), 20))
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the nodes are addressed by the hashes of their plaintext
+	plain := NewBTree(NewMemDatabase(), defaultKeyLength, bytes.Compare, WithBlobs(64))
+	for i := 0; i < testCount; i++ {
+		plain.Insert(Int64ToBytes(int64(i)), value(i))
+	}
+	plain.Insert(Int64ToBytes(int64(testCount)), bytes.Repeat([]byte("secret"), 20))
+	if err := plain.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bt.RootHash(), plain.RootHash()) {
+		t.Fatalf("root hash: want = %x, got = %x", plain.RootHash(), bt.RootHash())
+	}
+	for _, k := range raw.Keys() {
+		if v, _ := raw.Get(k); bytes.Contains(v, []byte("secret")) {
+			t.Fatalf("stored value %x: want encrypted, got = %q", k, v)
+		}
+	}
+
+	loaded, err := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolveAll(loaded, loaded.root, t)
+	verifyTree(loaded, testCount+1, t)
+	if v, ok, err := loaded.Search(Int64ToBytes(1234)); err != nil || !ok || !bytes.Equal(v, value(1234)) {
+		t.Errorf("search: got = %q, %v, %v", v, ok, err)
+	}
+
+	// the proofs hold the plaintext nodes
+	v, _, proof, err := bt.ProveSearch(Int64ToBytes(int64(testCount)), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok, err := VerifySearch(bt.RootHash(), Int64ToBytes(int64(testCount)), proof, defaultKeyLength, bytes.Compare); err != nil || !ok || !bytes.Equal(got, v) {
+		t.Errorf("verify search: got = %q, %v, %v", got, ok, err)
+	}
+
+	// the values can't be read without the key, nor moved under another key
+	other, _ := NewEncryptedDatabase(raw, key)
+	if _, err := LoadBTree(other, bt.RootHash(), defaultKeyLength, bytes.Compare); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("load with another key: want = %v, got = %v", ErrDecrypt, err)
+	}
+	data, _ := raw.Get(bt.RootHash())
+	raw.Put([]byte("moved"), data)
+	if _, err := db.Get([]byte("moved")); err != ErrDecrypt {
+		t.Errorf("get moved value: want = %v, got = %v", ErrDecrypt, err)
+	}
+	raw.Delete([]byte("moved"))
+	if _, err := NewEncryptedDatabase(raw, []byte("short")); err == nil {
+		t.Errorf("new with invalid key: want error")
+	}
+
+	// the same plaintext is encrypted with another nonce
+	db.Put([]byte("a"), value(0))
+	db.Put([]byte("b"), value(0))
+	a, _ := raw.Get([]byte("a"))
+	b, _ := raw.Get([]byte("b"))
+	if bytes.Equal(a[keyIDSize:keyIDSize+12], b[keyIDSize:keyIDSize+12]) {
+		t.Errorf("nonces: want distinct")
+	}
+	raw.Delete([]byte("a"))
+	raw.Delete([]byte("b"))
+
+	// the key is rotated by reencrypting the store
+	rotating, err := NewEncryptedDatabase(raw, key, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys [][]byte
+	err = Reachable(rotating, bt.RootHash(), defaultKeyLength, bytes.Compare, func(k []byte, blob bool) error {
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rotating.Reencrypt(keys); err != nil {
+		t.Fatal(err)
+	}
+	rotated, _ := NewEncryptedDatabase(raw, key)
+	loaded, err = LoadBTree(rotated, bt.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolveAll(loaded, loaded.root, t)
+	verifyTree(loaded, testCount+1, t)
+	if v, _, err := loaded.Search(Int64ToBytes(int64(testCount))); err != nil || len(v) != 120 {
+		t.Errorf("search blob after rotation: got = %q, %v", v, err)
+	}
+	if _, err := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("load with the old key: want = %v, got = %v", ErrDecrypt, err)
+	}
+}
+
+func TestCorruptNodes(t *testing.T) {
+	testCount := 10000
+	db := NewMemDatabase()
+	bt := NewBTree(db, defaultKeyLength, bytes.Compare, WithCompression(FlateCompression, DefaultCompressionThreshold))
+	for i := 0; i < testCount; i++ {
+		bt.Insert(Int64ToBytes(int64(i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	if err := bt.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	replica := NewMemDatabase()
+	for _, key := range db.Keys() {
+		v, _ := db.Get(key)
+		replica.Put(key, v)
+	}
+
+	// a leaf whose bytes still decode, but not to the node stored under its
+	// hash, fails to load
+	key := Int64ToBytes(int64(testCount / 2))
+	leaf, _, err := bt.seekLeaf(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt.runlatch(leaf)
+	path := pathOf(leaf.p)
+	if len(path) == 0 || !bytes.Equal(path[0], bt.RootHash()) {
+		t.Fatalf("path: got = %x", path)
+	}
+	_, hash, _ := leaf.cache()
+	other := bt.first
+	_, otherHash, data := other.cache()
+	db.Put(hash, data)
+
+	loaded, err := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = loaded.Search(key)
+	var corrupt *CorruptNodeError
+	if !errors.Is(err, ErrCorruptNode) || !errors.As(err, &corrupt) {
+		t.Fatalf("search corrupt leaf: want = %v, got = %v", ErrCorruptNode, err)
+	}
+	if !bytes.Equal(corrupt.Hash, hash) || fmt.Sprintf("%x", corrupt.Path) != fmt.Sprintf("%x", path) {
+		t.Errorf("corrupt node error: want = %x, %x, got = %x, %x", hash, path, corrupt.Hash, corrupt.Path)
+	}
+	if _, err := LoadBTree(db, hash, defaultKeyLength, bytes.Compare); !errors.As(err, &corrupt) || len(corrupt.Path) != 0 {
+		t.Errorf("load corrupt root: want an empty path, got = %v", err)
+	}
+	if err := Reachable(db, bt.RootHash(), defaultKeyLength, bytes.Compare, func([]byte, bool) error { return nil }); !errors.Is(err, ErrCorruptNode) {
+		t.Errorf("reachable: want = %v, got = %v", ErrCorruptNode, err)
+	}
+	if _, err := Migrate(db, bt.RootHash(), defaultKeyLength, bytes.Compare); !errors.Is(err, ErrCorruptNode) {
+		t.Errorf("migrate: want = %v, got = %v", ErrCorruptNode, err)
+	}
+
+	// the replica repairs the corrupt and the missing nodes
+	db.Delete(otherHash)
+	repaired, err := LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare, WithReplica(replica))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolveAll(repaired, repaired.root, t)
+	verifyTree(repaired, testCount, t)
+	if v, ok, err := repaired.Search(key); err != nil || !ok || string(v) != fmt.Sprintf("value%d", testCount/2) {
+		t.Errorf("search repaired leaf: got = %s, %v, %v", v, ok, err)
+	}
+	for _, h := range [][]byte{hash, otherHash} {
+		want, _ := replica.Get(h)
+		if got, err := db.Get(h); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("repaired node %x: want written back, got %v", h, err)
+		}
+	}
+
+	// a node corrupt in the replica as well still fails
+	db.Put(hash, data)
+	replica.Put(hash, data)
+	loaded, err = LoadBTree(db, bt.RootHash(), defaultKeyLength, bytes.Compare, WithReplica(replica))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loaded.Search(key); !errors.As(err, &corrupt) || !bytes.Equal(corrupt.Hash, hash) {
+		t.Errorf("search leaf corrupt in replica: want = %v, got = %v", ErrCorruptNode, err)
+	}
+}
@@ -0,0 +1,257 @@
+package bplustree
+
+// Tx is a group of updates on a BTree which are either all kept by Commit or
+// all undone by Rollback. The updates are applied to the tree right away, so
+// that the searches through the Tx see them, as do the searches on the tree
+// when it is not in concurrent mode. In concurrent mode the tree is locked
+// until the Tx is done: every operation on the tree other than through the Tx
+// blocks until then, and deadlocks if it is made by the goroutine running the
+// Tx. The tree must not be updated or committed other than through the Tx
+// until the Tx is done.
+type Tx struct {
+	bt   *BTree
+	ops  []txOp
+	done bool
+
+	// state of the tree and of every node modified by the Tx, from before
+	// the Tx began
+	root     *InteriorNode
+	first    *LeafNode
+	leaf     int
+	interior int
+	height   int
+	saved    map[Node]*nodeState
+}
+
+type txOp struct {
+	op    byte
+	key   []byte
+	value []byte
+}
+
+type nodeState struct {
+	count     int
+	kvs       []leafKV
+	kcs       []KC
+	p         *InteriorNode
+	next      *LeafNode
+	prev      *LeafNode
+	cacheHash []byte
+	cacheData []byte
+	dirty     bool
+}
+
+// Begin begins a transaction on the tree. Only one transaction can be in
+// progress on a tree at a time, in concurrent mode the tree is locked until
+// the transaction is done. It returns ErrTxInProgress if a transaction is
+// already in progress.
+func (bt *BTree) Begin() (*Tx, error) {
+	bt.lockTree()
+	if bt.tx != nil {
+		bt.unlockTree()
+		return nil, ErrTxInProgress
+	}
+	bt.tx = &Tx{
+		bt:       bt,
+		root:     bt.root,
+		first:    bt.first,
+		leaf:     bt.leaf,
+		interior: bt.interior,
+		height:   bt.height,
+		saved:    make(map[Node]*nodeState),
+	}
+	return bt.tx, nil
+}
+
+// Insert inserts a (Key, Value) into the tree within the transaction.
+func (tx *Tx) Insert(key []byte, value []byte) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if err := tx.bt.insert(key, value); err != nil {
+		return err
+	}
+	tx.ops = append(tx.ops, txOp{walInsert, key, value})
+	return nil
+}
+
+// Delete deletes the Key from the tree within the transaction, it returns
+// false if the Key does not exist.
+func (tx *Tx) Delete(key []byte) (bool, error) {
+	if tx.done {
+		return false, ErrTxDone
+	}
+	ok, err := tx.bt.delete(key)
+	if ok {
+		tx.ops = append(tx.ops, txOp{walDelete, key, nil})
+	}
+	return ok, err
+}
+
+// DeleteRange deletes all the Keys with start <= Key <= end from the tree
+// within the transaction, it returns the number of Keys deleted.
+func (tx *Tx) DeleteRange(start, end []byte) (int, error) {
+	return tx.deleteRange(keyRange{start: start, end: end, closed: true})
+}
+
+// DeletePrefix deletes all the Keys starting with prefix from the tree within
+// the transaction, it returns the number of Keys deleted.
+func (tx *Tx) DeletePrefix(prefix []byte) (int, error) {
+	r, err := tx.bt.prefixRange(prefix)
+	if err != nil {
+		return 0, err
+	}
+	return tx.deleteRange(r)
+}
+
+func (tx *Tx) deleteRange(r keyRange) (int, error) {
+	if tx.done {
+		return 0, ErrTxDone
+	}
+	n, err := tx.bt.deleteLogged(r)
+	if n > 0 {
+		key, value := r.encode()
+		tx.ops = append(tx.ops, txOp{walDeleteRange, key, value})
+	}
+	return n, err
+}
+
+// Search searches the Key in the tree, including the updates of the
+// transaction.
+func (tx *Tx) Search(key []byte) ([]byte, bool, error) {
+	return tx.bt.get(key)
+}
+
+// Commit keeps all the updates of the transaction. If the tree has a WAL
+// attached, the updates are logged as a single record, and the transaction
+// is rolled back if they can't be logged.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if tx.bt.wal != nil && len(tx.ops) > 0 {
+		if err := tx.bt.wal.appendTx(tx.ops); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	tx.finish()
+	return nil
+}
+
+// Rollback undoes all the updates of the transaction, restoring every node
+// it has modified, so that no node split or merged by the transaction is left
+// in the tree.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	bt := tx.bt
+	for n, state := range tx.saved {
+		state.restore(n)
+	}
+	bt.root = tx.root
+	bt.first = tx.first
+	bt.leaf = tx.leaf
+	bt.interior = tx.interior
+	bt.height = tx.height
+
+	tx.finish()
+	return nil
+}
+
+func (tx *Tx) finish() {
+	tx.done = true
+	tx.saved = nil
+	tx.ops = nil
+	tx.bt.tx = nil
+	tx.bt.unlockTree()
+}
+
+// touch saves the state of n before it is first modified by the transaction
+// in progress.
+func (bt *BTree) touch(n Node) {
+	if bt.tx == nil {
+		return
+	}
+	if _, ok := bt.tx.saved[n]; ok {
+		return
+	}
+	bt.tx.saved[n] = saveNode(n)
+}
+
+// touchPath touches n and all its ancestors.
+func (bt *BTree) touchPath(n Node) {
+	if bt.tx == nil {
+		return
+	}
+	for {
+		bt.touch(n)
+		p := n.parent()
+		if p == nil {
+			return
+		}
+		n = p
+	}
+}
+
+// touchChildren touches all the children of in, whose parent is about to change.
+func (bt *BTree) touchChildren(in *InteriorNode) {
+	if bt.tx == nil {
+		return
+	}
+	for i := 0; i < in.Count; i++ {
+		bt.touch(in.Kcs.data[i].Child)
+	}
+}
+
+func saveNode(n Node) *nodeState {
+	switch node := n.(type) {
+	case *LeafNode:
+		return &nodeState{
+			count:     node.Count,
+			kvs:       append([]leafKV(nil), node.Kvs.data[:node.Count]...),
+			p:         node.p,
+			next:      node.next,
+			prev:      node.prev,
+			cacheHash: node.cacheHash,
+			cacheData: node.cacheData,
+			dirty:     node.dirty,
+		}
+	case *InteriorNode:
+		return &nodeState{
+			count:     node.Count,
+			kcs:       append([]KC(nil), node.Kcs.data[:node.Count]...),
+			p:         node.p,
+			cacheHash: node.cacheHash,
+			cacheData: node.cacheData,
+			dirty:     node.dirty,
+		}
+	default:
+		return &nodeState{p: n.parent()}
+	}
+}
+
+func (s *nodeState) restore(n Node) {
+	switch node := n.(type) {
+	case *LeafNode:
+		copy(node.Kvs.data, s.kvs)
+		clearKVs(node.Kvs.data, s.count, len(node.Kvs.data))
+		node.Count = s.count
+		node.next = s.next
+		node.prev = s.prev
+		node.aggregated = false
+		node.cacheHash = s.cacheHash
+		node.cacheData = s.cacheData
+		node.dirty = s.dirty
+	case *InteriorNode:
+		copy(node.Kcs.data, s.kcs)
+		clearKCs(node.Kcs.data, s.count, len(node.Kcs.data))
+		node.Count = s.count
+		node.summed = false
+		node.cacheHash = s.cacheHash
+		node.cacheData = s.cacheData
+		node.dirty = s.dirty
+	}
+	n.setParent(s.p)
+}
@@ -0,0 +1,111 @@
+package bplustree
+
+// TypedTree is a BTree of Keys of type K and Values of type V, encoded to the
+// bytes of the tree by a KeyCodec and a ValueCodec.
+type TypedTree[K, V any] struct {
+	bt     *BTree
+	keys   KeyCodec[K]
+	values ValueCodec[V]
+}
+
+// TypedKV is a (Key, Value) of a TypedTree.
+type TypedKV[K, V any] struct {
+	Key   K
+	Value V
+}
+
+// NewTypedTree layers a TypedTree over bt, whose Key length must fit the
+// encoded Keys and whose cmpFunc must be the order preserved by keys.
+func NewTypedTree[K, V any](bt *BTree, keys KeyCodec[K], values ValueCodec[V]) *TypedTree[K, V] {
+	return &TypedTree[K, V]{bt: bt, keys: keys, values: values}
+}
+
+// Tree returns the underlying BTree, to commit it for instance.
+func (t *TypedTree[K, V]) Tree() *BTree { return t.bt }
+
+// Insert inserts a (Key, Value) into the tree.
+func (t *TypedTree[K, V]) Insert(key K, value V) error {
+	return t.bt.Insert(t.keys.EncodeKey(key), t.values.EncodeValue(value))
+}
+
+// Delete deletes the Key from the tree, it returns false if the Key does not
+// exist.
+func (t *TypedTree[K, V]) Delete(key K) (bool, error) {
+	return t.bt.Delete(t.keys.EncodeKey(key))
+}
+
+// Get returns the Value of the Key and true, or the zero Value and false if
+// the Key does not exist.
+func (t *TypedTree[K, V]) Get(key K) (V, bool, error) {
+	var value V
+	data, ok, err := t.bt.Search(t.keys.EncodeKey(key))
+	if err != nil || !ok {
+		return value, false, err
+	}
+	value, err = t.values.DecodeValue(data)
+	if err != nil {
+		return value, false, err
+	}
+	return value, true, nil
+}
+
+// Range returns all the KVs with start <= Key <= end.
+func (t *TypedTree[K, V]) Range(start, end K) ([]TypedKV[K, V], error) {
+	var result []TypedKV[K, V]
+	it := t.Iterate(start, end)
+	for it.Next() {
+		result = append(result, TypedKV[K, V]{it.Key(), it.Value()})
+	}
+	return result, it.Err()
+}
+
+// Iterate returns an iterator over the KVs with start <= Key <= end.
+func (t *TypedTree[K, V]) Iterate(start, end K) *TypedIterator[K, V] {
+	return &TypedIterator[K, V]{
+		it:   t.bt.Iterate(t.keys.EncodeKey(start), t.keys.EncodeKey(end)),
+		tree: t,
+	}
+}
+
+// All returns an iterator over all the KVs of the tree.
+func (t *TypedTree[K, V]) All() *TypedIterator[K, V] {
+	return &TypedIterator[K, V]{it: t.bt.Iterate(nil, nil), tree: t}
+}
+
+// TypedIterator walks the KVs of a TypedTree in Key order, like Iterator.
+type TypedIterator[K, V any] struct {
+	it    *Iterator
+	tree  *TypedTree[K, V]
+	key   K
+	value V
+	err   error
+}
+
+// Next moves the iterator to the next KV and decodes it, it returns false
+// when there are no KVs left or on error.
+func (it *TypedIterator[K, V]) Next() bool {
+	if it.err != nil || !it.it.Next() {
+		return false
+	}
+	if it.key, it.err = it.tree.keys.DecodeKey(it.it.Key()); it.err != nil {
+		return false
+	}
+	if it.value, it.err = it.tree.values.DecodeValue(it.it.Value()); it.err != nil {
+		return false
+	}
+	return true
+}
+
+// Key returns the Key of the current KV.
+func (it *TypedIterator[K, V]) Key() K { return it.key }
+
+// Value returns the Value of the current KV.
+func (it *TypedIterator[K, V]) Value() V { return it.value }
+
+// Err returns the error which stopped the iterator, if any.
+func (it *TypedIterator[K, V]) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.it.Err()
+}
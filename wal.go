@@ -0,0 +1,271 @@
+package bplustree
+
+import (
+	"bufio"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	walInsert = byte(0)
+	walDelete = byte(1)
+	walTx     = byte(2)
+
+	// the key and value of a walDeleteRange op hold an encoded keyRange
+	walDeleteRange = byte(3)
+)
+
+var (
+	errWALClosed     = errors.New("wal is closed")
+	errInvalidRecord = errors.New("invalid wal record")
+)
+
+// WAL is a write-ahead log of the updates applied to a BTree since its last
+// commit. Every update is appended and synced to the log before it is applied
+// to the tree, the log is truncated once the tree is committed.
+//
+// A record is laid out as:
+//
+//	crc32 (4) | size (4) | op (1) | key size (4) | key | value size (4) | value
+//
+// where crc32 covers everything after the size field. The updates of a
+// transaction are logged as a single walTx record, whose key holds the
+// encoded ops of all the updates, so that they are replayed all or none.
+type WAL struct {
+	f    *os.File
+	path string
+	lock sync.Mutex
+}
+
+// OpenWAL opens the write-ahead log at path, creating it if it does not exist.
+func OpenWAL(path string) (*WAL, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &WAL{f: f, path: path}, nil
+}
+
+func appendOp(b []byte, op byte, key, value []byte) []byte {
+	b = append(b, op)
+	b = append(b, Int32ToBytes(int32(len(key)))...)
+	b = append(b, key...)
+	b = append(b, Int32ToBytes(int32(len(value)))...)
+	b = append(b, value...)
+	return b
+}
+
+// readOp reads an op encoded by appendOp from data at offset pos.
+func readOp(data []byte, pos int) (op byte, key, value []byte, next int, err error) {
+	if pos >= len(data) {
+		return 0, nil, nil, 0, errInvalidRecord
+	}
+	op = data[pos]
+	if key, pos, err = readBytes(data, pos+1); err != nil {
+		return
+	}
+	value, next, err = readBytes(data, pos)
+	return
+}
+
+func (w *WAL) append(op byte, key, value []byte) error {
+	return w.write(appendOp(make([]byte, 0, 9+len(key)+len(value)), op, key, value))
+}
+
+func (w *WAL) appendTx(ops []txOp) error {
+	var tx []byte
+	for _, op := range ops {
+		tx = appendOp(tx, op.op, op.key, op.value)
+	}
+	return w.append(walTx, tx, nil)
+}
+
+func (w *WAL) write(payload []byte) error {
+	record := make([]byte, 0, 8+len(payload))
+	record = append(record, Int32ToBytes(int32(crc32.ChecksumIEEE(payload)))...)
+	record = append(record, Int32ToBytes(int32(len(payload)))...)
+	record = append(record, payload...)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.f == nil {
+		return errWALClosed
+	}
+	if _, err := w.f.Write(record); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+// replay calls fn for every record in the log in order. A torn or corrupted
+// record at the tail of the log, left by a crash in the middle of an append,
+// ends the replay and is cut off the log.
+func (w *WAL) replay(fn func(op byte, key, value []byte) error) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.f == nil {
+		return errWALClosed
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(w.f)
+	header := make([]byte, 8)
+	offset := int64(0)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		size := int(BytesToInt32(header[4:]))
+		if size < 9 {
+			break
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		if uint32(BytesToInt32(header)) != crc32.ChecksumIEEE(payload) {
+			break
+		}
+		op, key, value, pos, err := readOp(payload, 0)
+		if err != nil || pos != len(payload) {
+			break
+		}
+		if op == walTx {
+			err = replayTx(key, fn)
+		} else {
+			err = fn(op, key, value)
+		}
+		if err != nil {
+			return err
+		}
+		offset += int64(8 + size)
+	}
+
+	if err := w.f.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := w.f.Seek(offset, io.SeekStart)
+	return err
+}
+
+func replayTx(tx []byte, fn func(op byte, key, value []byte) error) error {
+	for pos := 0; pos < len(tx); {
+		op, key, value, next, err := readOp(tx, pos)
+		if err != nil {
+			return err
+		}
+		if err := fn(op, key, value); err != nil {
+			return err
+		}
+		pos = next
+	}
+	return nil
+}
+
+// size returns the size of the log, which is the offset of the next record.
+func (w *WAL) size() (int64, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.f == nil {
+		return 0, errWALClosed
+	}
+	info, err := w.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// truncateBefore drops the records before offset, keeping the ones appended
+// after it. The kept records are written to a new file which then replaces
+// the log, so that a crash never leaves a partially rewritten log, and the
+// directory of the log is synced so that the replacement is durable.
+func (w *WAL) truncateBefore(offset int64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.f == nil {
+		return errWALClosed
+	}
+	info, err := w.f.Stat()
+	if err != nil {
+		return err
+	}
+	tail := make([]byte, info.Size()-offset)
+	if _, err := w.f.ReadAt(tail, offset); err != nil {
+		return err
+	}
+
+	tmp := w.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(tail); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		f.Close()
+		return err
+	}
+	w.f.Close()
+	w.f = f
+
+	// the rename itself only survives a crash once the directory is synced,
+	// or else the old log comes back with the records already committed
+	return syncDir(w.path)
+}
+
+// syncDir syncs the directory holding the file at path.
+func syncDir(path string) error {
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// truncate drops all the records of the log.
+func (w *WAL) truncate() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.f == nil {
+		return errWALClosed
+	}
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+// Close closes the log file.
+func (w *WAL) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}